@@ -0,0 +1,179 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+)
+
+// AdaptiveLimiter bounds the number of concurrent operations with a limit that adapts to the observed
+// latency and errors of those operations. The limit grows by one while operations succeed and the limiter
+// is busy, and shrinks multiplicatively when an operation fails or is slower than the latency threshold.
+type AdaptiveLimiter interface {
+	// Acquire reserves a slot. It returns ok=false straight away when the current limit has been reached.
+	// Otherwise release must be called once the operation completes, reporting whether it succeeded.
+	Acquire() (release func(success bool), ok bool)
+	Limit() int
+	InFlight() int
+}
+
+// AdaptiveLimiterConfig configures an AdaptiveLimiter. Zero values are replaced with defaults.
+type AdaptiveLimiterConfig struct {
+	// InitialLimit is the limit used before any operations have been observed. Defaults to 20.
+	InitialLimit int
+	// MinLimit is the lowest the limit can fall to. Defaults to 1.
+	MinLimit int
+	// MaxLimit is the highest the limit can grow to. Defaults to 200.
+	MaxLimit int
+	// BackoffRatio multiplies the limit when an operation fails or is too slow. Defaults to 0.9.
+	BackoffRatio float64
+	// LatencyThreshold treats operations slower than this as failures. Zero disables the latency check.
+	LatencyThreshold time.Duration
+}
+
+const (
+	defaultInitialLimit = 20
+	defaultMinLimit     = 1
+	defaultMaxLimit     = 200
+	defaultBackoffRatio = 0.9
+)
+
+// ErrLimitExceeded is returned when a request is rejected because a limiter is full
+var ErrLimitExceeded = errors.New("concurrency limit exceeded")
+
+type adaptiveLimiter struct {
+	mu       sync.Mutex
+	name     string
+	config   AdaptiveLimiterConfig
+	limit    float64
+	inFlight int
+	statsd   StatsD
+	clock    clock
+}
+
+// NewAdaptiveLimiter creates an AIMD AdaptiveLimiter. The current limit is reported to statsd as a gauge
+// tagged with the limiter name.
+func NewAdaptiveLimiter(name string, config AdaptiveLimiterConfig, statsd StatsD) (AdaptiveLimiter, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	l := &adaptiveLimiter{
+		name:   name,
+		config: config,
+		limit:  float64(config.InitialLimit),
+		statsd: statsd,
+		clock:  &timeClock{},
+	}
+	l.reportLimit(l.limit)
+	return l, nil
+}
+
+func (c AdaptiveLimiterConfig) withDefaults() AdaptiveLimiterConfig {
+	if c.InitialLimit == 0 {
+		c.InitialLimit = defaultInitialLimit
+	}
+	if c.MinLimit == 0 {
+		c.MinLimit = defaultMinLimit
+	}
+	if c.MaxLimit == 0 {
+		c.MaxLimit = defaultMaxLimit
+	}
+	if c.BackoffRatio == 0 {
+		c.BackoffRatio = defaultBackoffRatio
+	}
+	return c
+}
+
+func (c AdaptiveLimiterConfig) validate() error {
+	if c.MinLimit < 1 || c.MinLimit > c.MaxLimit {
+		return fmt.Errorf("the minimum limit should be between 1 and %d, got %d", c.MaxLimit, c.MinLimit)
+	}
+	if c.InitialLimit < c.MinLimit || c.InitialLimit > c.MaxLimit {
+		return fmt.Errorf("the initial limit should be between %d and %d, got %d", c.MinLimit, c.MaxLimit, c.InitialLimit)
+	}
+	if c.BackoffRatio <= 0 || c.BackoffRatio >= 1 {
+		return fmt.Errorf("the backoff ratio should be between 0 and 1, got %f", c.BackoffRatio)
+	}
+	return nil
+}
+
+// Acquire reserves a slot if the current limit allows it
+func (l *adaptiveLimiter) Acquire() (release func(success bool), ok bool) {
+	l.mu.Lock()
+	if l.inFlight >= int(l.limit) {
+		l.mu.Unlock()
+		return nil, false
+	}
+	l.inFlight++
+	l.mu.Unlock()
+
+	start := l.clock.Now()
+	var once sync.Once
+	release = func(success bool) {
+		once.Do(func() {
+			l.release(success, l.clock.Now().Sub(start))
+		})
+	}
+	return release, true
+}
+
+func (l *adaptiveLimiter) release(success bool, latency time.Duration) {
+	l.mu.Lock()
+	inFlight := l.inFlight
+	l.inFlight--
+	tooSlow := l.config.LatencyThreshold > 0 && latency > l.config.LatencyThreshold
+	if !success || tooSlow {
+		l.limit = math.Max(float64(l.config.MinLimit), l.limit*l.config.BackoffRatio)
+	} else if inFlight*2 >= int(l.limit) {
+		// Only grow when the limiter is actually being used, otherwise the limit drifts up to the maximum
+		// while idle and offers no protection when load arrives.
+		l.limit = math.Min(float64(l.config.MaxLimit), l.limit+1)
+	}
+	limit := l.limit
+	l.mu.Unlock()
+
+	l.reportLimit(limit)
+}
+
+func (l *adaptiveLimiter) reportLimit(limit float64) {
+	l.statsd.Gauge(AdaptiveLimiterLimitKey, math.Floor(limit), "limiter:"+l.name)
+}
+
+// Limit returns the current limit
+func (l *adaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// InFlight returns the number of slots currently acquired
+func (l *adaptiveLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// AdaptiveLimiterHandler sheds requests to handler with a 503 once limiter is full. Responses with a 5xx
+// status code count as failures and reduce the limit. Requests to /internal/ paths are never limited.
+func AdaptiveLimiterHandler(routeName string, limiter AdaptiveLimiter, handler http.Handler, statsd StatsD) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isInternalPath(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		release, ok := limiter.Acquire()
+		if !ok {
+			shedRequest(w, r, routeName, defaultShedRetryAfter, statsd)
+			return
+		}
+		code := http.StatusInternalServerError
+		defer func() { release(code < http.StatusInternalServerError) }()
+		code = httpsnoop.CaptureMetrics(handler, w, r).Code
+	})
+}
@@ -0,0 +1,153 @@
+package tools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdaptiveLimiter(t *testing.T, config AdaptiveLimiterConfig) (*adaptiveLimiter, *MockStatsD) {
+	msd := &MockStatsD{}
+	limiter, err := NewAdaptiveLimiter("test", config, msd)
+	if err != nil {
+		t.Fatalf("failed to create an adaptive limiter %v", err)
+	}
+	l := limiter.(*adaptiveLimiter)
+	l.clock = newFakeClock(100 * time.Millisecond)
+	return l, msd
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+
+	t.Run("should not create a limiter with an invalid config", func(t *testing.T) {
+		_, err := NewAdaptiveLimiter("test", AdaptiveLimiterConfig{InitialLimit: 10, MaxLimit: 5}, &MockStatsD{})
+		assert.Error(t, err)
+
+		_, err = NewAdaptiveLimiter("test", AdaptiveLimiterConfig{BackoffRatio: 1.5}, &MockStatsD{})
+		assert.Error(t, err)
+	})
+
+	t.Run("should reject once the limit is reached", func(t *testing.T) {
+		l, _ := newTestAdaptiveLimiter(t, AdaptiveLimiterConfig{InitialLimit: 2})
+
+		release1, ok1 := l.Acquire()
+		_, ok2 := l.Acquire()
+		_, ok3 := l.Acquire()
+
+		assert.True(t, ok1)
+		assert.True(t, ok2)
+		assert.False(t, ok3)
+		assert.Equal(t, 2, l.InFlight())
+
+		release1(true)
+
+		_, ok4 := l.Acquire()
+		assert.True(t, ok4)
+	})
+
+	t.Run("should grow the limit on success while busy", func(t *testing.T) {
+		l, msd := newTestAdaptiveLimiter(t, AdaptiveLimiterConfig{InitialLimit: 2})
+
+		release, _ := l.Acquire()
+		release(true)
+
+		assert.Equal(t, 3, l.Limit())
+		last := msd.Calls[len(msd.Calls)-1]
+		assert.Equal(t, "Gauge", last.Method)
+		assert.Equal(t, AdaptiveLimiterLimitKey, last.Args.Name)
+		assert.Equal(t, 3.0, last.Args.Value)
+		assert.Equal(t, []string{"limiter:test"}, last.Args.Tags)
+	})
+
+	t.Run("should not grow the limit while idle", func(t *testing.T) {
+		l, _ := newTestAdaptiveLimiter(t, AdaptiveLimiterConfig{InitialLimit: 10})
+
+		release, _ := l.Acquire()
+		release(true)
+
+		assert.Equal(t, 10, l.Limit())
+	})
+
+	t.Run("should back off on failure but not below the minimum", func(t *testing.T) {
+		l, _ := newTestAdaptiveLimiter(t, AdaptiveLimiterConfig{InitialLimit: 10, MinLimit: 8, BackoffRatio: 0.5})
+
+		release, _ := l.Acquire()
+		release(false)
+
+		assert.Equal(t, 8, l.Limit())
+	})
+
+	t.Run("should back off when slower than the latency threshold", func(t *testing.T) {
+		l, _ := newTestAdaptiveLimiter(t, AdaptiveLimiterConfig{InitialLimit: 10, LatencyThreshold: 50 * time.Millisecond})
+
+		release, _ := l.Acquire()
+		release(true)
+
+		assert.Equal(t, 9, l.Limit())
+	})
+
+	t.Run("should only count a release once", func(t *testing.T) {
+		l, _ := newTestAdaptiveLimiter(t, AdaptiveLimiterConfig{InitialLimit: 10})
+
+		release, _ := l.Acquire()
+		release(true)
+		release(true)
+
+		assert.Equal(t, 0, l.InFlight())
+	})
+}
+
+func TestAdaptiveLimiterHandler(t *testing.T) {
+	l, _ := newTestAdaptiveLimiter(t, AdaptiveLimiterConfig{InitialLimit: 1})
+	msd := &MockStatsD{}
+	handler := AdaptiveLimiterHandler("route", l, &MockHandler{response: http.StatusInternalServerError}, msd)
+
+	release, _ := l.Acquire()
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("X-Component", "my-caller")
+	shed := httptest.NewRecorder()
+	handler.ServeHTTP(shed, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, shed.Code)
+	assert.Equal(t, "1", shed.Header().Get("Retry-After"))
+	assert.Len(t, msd.Calls, 1)
+	assert.Equal(t, WebRequestShedKey, msd.Calls[0].Args.Name)
+	assert.Equal(t, []string{"route:route", "response:503", "caller:my-caller"}, msd.Calls[0].Args.Tags)
+
+	release(true)
+	served := httptest.NewRecorder()
+	handler.ServeHTTP(served, req)
+
+	assert.Equal(t, http.StatusInternalServerError, served.Code)
+	assert.Equal(t, 0, l.InFlight())
+}
+
+func TestHTTPClientWithStats_AdaptiveLimiter(t *testing.T) {
+	l, _ := newTestAdaptiveLimiter(t, AdaptiveLimiterConfig{InitialLimit: 1})
+	msd := &MockStatsD{}
+	wc := NewHTTPClientWithStats(http.DefaultClient, msd, WithAdaptiveLimiter(l))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	resp, err := wc.Get(ts.URL, "http_callee:my-remote-service")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 0, l.InFlight())
+
+	release, _ := l.Acquire()
+	defer release(true)
+	msd.Calls = nil
+
+	resp, err = wc.Get(ts.URL, "http_callee:my-remote-service")
+
+	assert.Nil(t, resp)
+	assert.Equal(t, ErrLimitExceeded, err)
+	assert.Len(t, msd.Calls, 1)
+	assert.Equal(t, HttpClientLimitedKey, msd.Calls[0].Args.Name)
+	assert.Equal(t, []string{"http_callee:my-remote-service", "method:GET", "http_host:" + ts.Listener.Addr().String()}, msd.Calls[0].Args.Tags)
+}
@@ -0,0 +1,297 @@
+package tools
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxTagValues   = 100
+	maxMetricNameLength   = 200
+	maxTagLength          = 200
+	overflowTagValue      = "other"
+	dropReasonInvalid     = "reason:invalid"
+	dropReasonNotAllowed  = "reason:not_allowed"
+	rewriteReasonInvalid  = "reason:invalid"
+	rewriteReasonOverflow = "reason:overflow"
+	// guardEventsName is what event tags are guarded and reported under, as titles are free text
+	guardEventsName = "event"
+)
+
+// CardinalityGuardConfig configures NewCardinalityGuard. Zero values are replaced with defaults.
+type CardinalityGuardConfig struct {
+	// MaxTagValues is the number of distinct values each tag key can have on a metric. Any further values are
+	// replaced with "other". Defaults to 100.
+	MaxTagValues int
+	// AllowedTagKeys drops any tag whose key isn't in the list. All keys are allowed when it is empty.
+	AllowedTagKeys []string
+}
+
+type cardinalityGuard struct {
+	statsd       StatsD
+	maxTagValues int
+	allowed      map[string]bool
+	mu           sync.Mutex
+	seen         map[string]map[string]map[string]struct{}
+}
+
+type guardReport struct {
+	dropped   map[string]int64
+	rewritten map[string]int64
+}
+
+// NewCardinalityGuard wraps statsd to protect against tags that would explode cardinality and cost, such as
+// a caller tag taken from an arbitrary X-Component header. Metric names and tags are checked against
+// Datadog's rules: invalid characters are replaced with underscores, tags are lowercased, both are truncated
+// to 200 characters, and names or tags that don't start with a letter are dropped. Each tag key on a metric
+// is limited to MaxTagValues distinct values, with any more replaced by "other".
+//
+// Dropped metrics are counted in statsd.metrics_dropped, and dropped and rewritten tags in
+// statsd.tags_dropped and statsd.tags_rewritten, tagged with the metric and the reason.
+func NewCardinalityGuard(statsd StatsD, config CardinalityGuardConfig) StatsD {
+	if config.MaxTagValues == 0 {
+		config.MaxTagValues = defaultMaxTagValues
+	}
+	var allowed map[string]bool
+	if len(config.AllowedTagKeys) > 0 {
+		allowed = make(map[string]bool, len(config.AllowedTagKeys))
+		for _, key := range config.AllowedTagKeys {
+			allowed[key] = true
+		}
+	}
+	return &cardinalityGuard{
+		statsd:       statsd,
+		maxTagValues: config.MaxTagValues,
+		allowed:      allowed,
+		seen:         make(map[string]map[string]map[string]struct{}),
+	}
+}
+
+func (g *cardinalityGuard) Histogram(name string, value float64, tags ...string) {
+	if name, tags, ok := g.guard(name, tags); ok {
+		g.statsd.Histogram(name, value, tags...)
+	}
+}
+
+func (g *cardinalityGuard) Gauge(name string, value float64, tags ...string) {
+	if name, tags, ok := g.guard(name, tags); ok {
+		g.statsd.Gauge(name, value, tags...)
+	}
+}
+
+func (g *cardinalityGuard) Incr(name string, tags ...string) {
+	if name, tags, ok := g.guard(name, tags); ok {
+		g.statsd.Incr(name, tags...)
+	}
+}
+
+func (g *cardinalityGuard) Count(name string, value int64, tags ...string) {
+	if name, tags, ok := g.guard(name, tags); ok {
+		g.statsd.Count(name, value, tags...)
+	}
+}
+
+func (g *cardinalityGuard) Timing(name string, value time.Duration, tags ...string) {
+	if name, tags, ok := g.guard(name, tags); ok {
+		g.statsd.Timing(name, value, tags...)
+	}
+}
+
+func (g *cardinalityGuard) Distribution(name string, value float64, tags ...string) {
+	if name, tags, ok := g.guard(name, tags); ok {
+		g.statsd.Distribution(name, value, tags...)
+	}
+}
+
+func (g *cardinalityGuard) Set(name string, value string, tags ...string) {
+	if name, tags, ok := g.guard(name, tags); ok {
+		g.statsd.Set(name, value, tags...)
+	}
+}
+
+func (g *cardinalityGuard) Decr(name string, tags ...string) {
+	if name, tags, ok := g.guard(name, tags); ok {
+		g.statsd.Decr(name, tags...)
+	}
+}
+
+// Event guards the tags of event. Its title is free text, so it isn't checked, and the tags of all events are
+// limited together rather than per title.
+func (g *cardinalityGuard) Event(event *StatsDEvent) {
+	e := *event
+	e.Tags = g.guardTags(guardEventsName, e.Tags)
+	g.statsd.Event(&e)
+}
+
+func (g *cardinalityGuard) ServiceCheck(check *StatsDServiceCheck) {
+	name, tags, ok := g.guard(check.Name, check.Tags)
+	if !ok {
+		return
+	}
+	sc := *check
+	sc.Name, sc.Tags = name, tags
+	g.statsd.ServiceCheck(&sc)
+}
+
+func (g *cardinalityGuard) Flush() error {
+	return g.statsd.Flush()
+}
+
+func (g *cardinalityGuard) Close() error {
+	return g.statsd.Close()
+}
+
+func (g *cardinalityGuard) errorCounts() (sent, failed int64, ok bool) {
+	return errorCountsOf(g.statsd)
+}
+
+// WithContext adds the tags carried by ctx before they are guarded
+func (g *cardinalityGuard) WithContext(ctx context.Context) StatsD {
+	return withContext(g, ctx)
+}
+
+// WithPrefix adds prefix to the name of every metric before it is guarded
+func (g *cardinalityGuard) WithPrefix(prefix string) StatsD {
+	return withPrefix(g, prefix)
+}
+
+// WithTags adds tags to every metric before they are guarded
+func (g *cardinalityGuard) WithTags(tags ...string) StatsD {
+	return withTags(g, tags...)
+}
+
+func (g *cardinalityGuard) StartTimer(name string, tags ...string) *Timer {
+	return StartTimer(g, name, tags...)
+}
+
+func (g *cardinalityGuard) guard(name string, tags []string) (string, []string, bool) {
+	cleanName, ok := sanitizeMetricName(name)
+	if !ok {
+		g.statsd.Incr(CardinalityMetricsDroppedKey, dropReasonInvalid)
+		return name, tags, false
+	}
+	return cleanName, g.guardTags(cleanName, tags), true
+}
+
+func (g *cardinalityGuard) guardTags(name string, tags []string) []string {
+	report := guardReport{dropped: map[string]int64{}, rewritten: map[string]int64{}}
+	guarded := make([]string, 0, len(tags))
+
+	g.mu.Lock()
+	for _, tag := range tags {
+		clean, ok := sanitizeTag(tag)
+		if !ok {
+			report.dropped[dropReasonInvalid]++
+			continue
+		}
+		// Datadog lowercases tags itself, so only changing the case isn't a rewrite
+		if clean != strings.ToLower(tag) {
+			report.rewritten[rewriteReasonInvalid]++
+		}
+		key, value, hasValue := strings.Cut(clean, ":")
+		if !hasValue {
+			key, value = "", clean
+		}
+		if g.allowed != nil && !g.allowed[key] {
+			report.dropped[dropReasonNotAllowed]++
+			continue
+		}
+		if g.overflows(name, key, value) {
+			report.rewritten[rewriteReasonOverflow]++
+			clean = overflowTagValue
+			if hasValue {
+				clean = key + ":" + overflowTagValue
+			}
+		}
+		guarded = append(guarded, clean)
+	}
+	g.mu.Unlock()
+
+	g.report(name, report)
+	return guarded
+}
+
+// overflows records value for the key on a metric and reports whether it is beyond the limit of distinct
+// values. It must be called with the lock held.
+func (g *cardinalityGuard) overflows(name, key, value string) bool {
+	keys, ok := g.seen[name]
+	if !ok {
+		keys = make(map[string]map[string]struct{})
+		g.seen[name] = keys
+	}
+	values, ok := keys[key]
+	if !ok {
+		values = make(map[string]struct{})
+		keys[key] = values
+	}
+	if _, ok := values[value]; ok {
+		return false
+	}
+	if len(values) >= g.maxTagValues {
+		return true
+	}
+	values[value] = struct{}{}
+	return false
+}
+
+func (g *cardinalityGuard) report(name string, report guardReport) {
+	for reason, count := range report.dropped {
+		g.statsd.Count(CardinalityTagsDroppedKey, count, "metric:"+name, reason)
+	}
+	for reason, count := range report.rewritten {
+		g.statsd.Count(CardinalityTagsRewrittenKey, count, "metric:"+name, reason)
+	}
+}
+
+// sanitizeMetricName applies Datadog's metric naming rules. Names must start with a letter, only contain
+// ASCII letters, digits, underscores and periods, and be at most 200 characters long.
+func sanitizeMetricName(name string) (string, bool) {
+	if name == "" || !isASCIILetter(name[0]) {
+		return name, false
+	}
+	return truncate(replaceInvalid(name, isMetricNameChar), maxMetricNameLength), true
+}
+
+// sanitizeTag applies Datadog's tag rules. Tags must start with a letter, only contain ASCII letters,
+// digits, underscores, minuses, colons, periods and slashes, and be at most 200 characters long. Datadog
+// lowercases tags, so that is done here too to avoid surprises in the cardinality limits.
+func sanitizeTag(tag string) (string, bool) {
+	if tag == "" || !isASCIILetter(tag[0]) {
+		return tag, false
+	}
+	return truncate(replaceInvalid(strings.ToLower(tag), isTagChar), maxTagLength), true
+}
+
+func replaceInvalid(s string, valid func(byte) bool) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		if r < 128 && valid(byte(r)) {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func truncate(s string, length int) string {
+	if len(s) > length {
+		return s[:length]
+	}
+	return s
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isMetricNameChar(c byte) bool {
+	return isASCIILetter(c) || (c >= '0' && c <= '9') || c == '_' || c == '.'
+}
+
+func isTagChar(c byte) bool {
+	return isMetricNameChar(c) || c == '-' || c == ':' || c == '/'
+}
@@ -0,0 +1,115 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityGuard(t *testing.T) {
+
+	t.Run("should pass valid metrics through unchanged", func(t *testing.T) {
+		msd := &MockStatsD{}
+		g := NewCardinalityGuard(msd, CardinalityGuardConfig{})
+
+		g.Histogram("web.response_time", 10, "route:/hello", "method:get")
+
+		assert.Equal(t, []Call{{"Histogram", Args{"web.response_time", 10, []string{"route:/hello", "method:get"}}}}, msd.Calls)
+	})
+
+	t.Run("should sanitise names and tags and report rewrites", func(t *testing.T) {
+		msd := &MockStatsD{}
+		g := NewCardinalityGuard(msd, CardinalityGuardConfig{})
+
+		g.Incr("web.response-time", "Caller:My Caller", "1bad")
+
+		assert.Len(t, msd.Calls, 3)
+		assert.Equal(t, Args{"web.response_time", 0, []string{"caller:my_caller"}}, msd.Calls[2].Args)
+		reports := map[string]Args{msd.Calls[0].Args.Name: msd.Calls[0].Args, msd.Calls[1].Args.Name: msd.Calls[1].Args}
+		assert.Equal(t, Args{CardinalityTagsDroppedKey, 1, []string{"metric:web.response_time", "reason:invalid"}}, reports[CardinalityTagsDroppedKey])
+		assert.Equal(t, Args{CardinalityTagsRewrittenKey, 1, []string{"metric:web.response_time", "reason:invalid"}}, reports[CardinalityTagsRewrittenKey])
+	})
+
+	t.Run("should lowercase tags without reporting a rewrite", func(t *testing.T) {
+		msd := &MockStatsD{}
+		g := NewCardinalityGuard(msd, CardinalityGuardConfig{})
+
+		g.Incr("web.request", "method:GET")
+
+		assert.Equal(t, []Call{{"Incr", Args{"web.request", 0, []string{"method:get"}}}}, msd.Calls)
+	})
+
+	t.Run("should drop metrics with invalid names", func(t *testing.T) {
+		msd := &MockStatsD{}
+		g := NewCardinalityGuard(msd, CardinalityGuardConfig{})
+
+		g.Gauge("2xx", 1)
+
+		assert.Equal(t, []Call{{"Incr", Args{CardinalityMetricsDroppedKey, 0, []string{"reason:invalid"}}}}, msd.Calls)
+	})
+
+	t.Run("should truncate long names and tags", func(t *testing.T) {
+		msd := &MockStatsD{}
+		g := NewCardinalityGuard(msd, CardinalityGuardConfig{})
+
+		g.Incr(strings.Repeat("a", 300), "tag:"+strings.Repeat("b", 300))
+
+		last := msd.Calls[len(msd.Calls)-1]
+		assert.Len(t, last.Args.Name, 200)
+		assert.Len(t, last.Args.Tags[0], 200)
+	})
+
+	t.Run("should replace values over the limit with other", func(t *testing.T) {
+		msd := &MockStatsD{}
+		g := NewCardinalityGuard(msd, CardinalityGuardConfig{MaxTagValues: 2})
+
+		g.Incr("requests", "caller:a")
+		g.Incr("requests", "caller:b")
+		g.Incr("requests", "caller:c", "route:/x")
+		g.Incr("requests", "caller:a")
+		g.Incr("other_metric", "caller:c")
+
+		assert.Equal(t, []string{"caller:a"}, msd.Calls[0].Args.Tags)
+		assert.Equal(t, []string{"caller:b"}, msd.Calls[1].Args.Tags)
+		assert.Equal(t, Args{CardinalityTagsRewrittenKey, 1, []string{"metric:requests", "reason:overflow"}}, msd.Calls[2].Args)
+		assert.Equal(t, []string{"caller:other", "route:/x"}, msd.Calls[3].Args.Tags)
+		assert.Equal(t, []string{"caller:a"}, msd.Calls[4].Args.Tags)
+		assert.Equal(t, []string{"caller:c"}, msd.Calls[5].Args.Tags)
+	})
+
+	t.Run("should drop tags that aren't allowed", func(t *testing.T) {
+		msd := &MockStatsD{}
+		g := NewCardinalityGuard(msd, CardinalityGuardConfig{AllowedTagKeys: []string{"route"}})
+
+		g.Incr("requests", "route:/hello", "user_id:123")
+
+		assert.Equal(t, Args{CardinalityTagsDroppedKey, 1, []string{"metric:requests", "reason:not_allowed"}}, msd.Calls[0].Args)
+		assert.Equal(t, []string{"route:/hello"}, msd.Calls[1].Args.Tags)
+	})
+
+	t.Run("should guard event and service check tags", func(t *testing.T) {
+		msd := &MockStatsD{}
+		g := NewCardinalityGuard(msd, CardinalityGuardConfig{AllowedTagKeys: []string{"route"}})
+		event := &StatsDEvent{Title: "Deployed v1.2!", Tags: []string{"route:/a", "user_id:1"}}
+
+		g.Event(event)
+		g.ServiceCheck(&StatsDServiceCheck{Name: "search.up", Tags: []string{"route:/a"}})
+
+		assert.Equal(t, Args{CardinalityTagsDroppedKey, 1, []string{"metric:event", "reason:not_allowed"}}, msd.Calls[0].Args)
+		assert.Equal(t, Args{"Deployed v1.2!", 0, []string{"route:/a"}}, msd.Calls[1].Args)
+		assert.Equal(t, []string{"route:/a", "user_id:1"}, event.Tags)
+		assert.Equal(t, Args{"search.up", 0, []string{"route:/a"}}, msd.Calls[2].Args)
+	})
+
+	t.Run("should limit event tags together instead of per title", func(t *testing.T) {
+		msd := &MockStatsD{}
+		g := NewCardinalityGuard(msd, CardinalityGuardConfig{MaxTagValues: 1})
+
+		g.Event(&StatsDEvent{Title: "Deployed v1", Tags: []string{"version:1"}})
+		g.Event(&StatsDEvent{Title: "Deployed v2", Tags: []string{"version:2"}})
+
+		assert.Equal(t, Args{CardinalityTagsRewrittenKey, 1, []string{"metric:event", "reason:overflow"}}, msd.Calls[1].Args)
+		assert.Equal(t, Args{"Deployed v2", 0, []string{"version:other"}}, msd.Calls[2].Args)
+	})
+}
@@ -0,0 +1,355 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const dogStatsDMaxPacketSize = 65536
+
+// DogStatsDMetric is a metric received by a DogStatsDServer. Set values are kept in Text, every other value
+// is in Value. Metrics sent with several values in one line are split into one DogStatsDMetric per value.
+type DogStatsDMetric struct {
+	Name       string
+	Value      float64
+	Text       string
+	Type       string
+	SampleRate float64
+	Tags       []string
+}
+
+// DogStatsDServer is a stand-in for the Datadog agent in tests. It listens for the DogStatsD protocol on UDP
+// or a Unix domain socket and keeps every metric, event and service check it receives, so that the StatsD
+// from NewStatsD can be tested end to end. Names include the namespace and tags include the global tags.
+type DogStatsDServer struct {
+	t       testing.TB
+	conn    net.PacketConn
+	address string
+	done    chan struct{}
+
+	mu            sync.Mutex
+	metrics       []DogStatsDMetric
+	events        []StatsDEvent
+	serviceChecks []StatsDServiceCheck
+	changed       chan struct{}
+}
+
+// NewDogStatsDServer starts a DogStatsDServer on a random local UDP port. It is closed when the test ends.
+func NewDogStatsDServer(t testing.TB) *DogStatsDServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen for DogStatsD over UDP ", err)
+	}
+	return startDogStatsDServer(t, conn, conn.LocalAddr().String())
+}
+
+// NewDogStatsDUDSServer starts a DogStatsDServer on a Unix domain socket in a temporary directory. It is
+// closed when the test ends.
+func NewDogStatsDUDSServer(t testing.TB) *DogStatsDServer {
+	t.Helper()
+	// Socket paths are limited to around 100 characters, which t.TempDir can go over
+	dir, err := os.MkdirTemp("", "dsd")
+	if err != nil {
+		t.Fatal("failed to create a directory for the DogStatsD socket ", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "dsd.socket")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal("failed to listen for DogStatsD over UDS ", err)
+	}
+	return startDogStatsDServer(t, conn, "unix://"+path)
+}
+
+func startDogStatsDServer(t testing.TB, conn net.PacketConn, address string) *DogStatsDServer {
+	s := &DogStatsDServer{t: t, conn: conn, address: address, done: make(chan struct{})}
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Address is the address of the server, to use with WithAddress
+func (s *DogStatsDServer) Address() string {
+	return s.address
+}
+
+// Metrics returns every metric received so far
+func (s *DogStatsDServer) Metrics() []DogStatsDMetric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.metrics)
+}
+
+// MetricsNamed returns every metric received so far for name, which includes the namespace
+func (s *DogStatsDServer) MetricsNamed(name string) []DogStatsDMetric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var metrics []DogStatsDMetric
+	for _, m := range s.metrics {
+		if m.Name == name {
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics
+}
+
+// Events returns every event received so far
+func (s *DogStatsDServer) Events() []StatsDEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.events)
+}
+
+// ServiceChecks returns every service check received so far
+func (s *DogStatsDServer) ServiceChecks() []StatsDServiceCheck {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.serviceChecks)
+}
+
+// Reset forgets everything received so far
+func (s *DogStatsDServer) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics, s.events, s.serviceChecks = nil, nil, nil
+}
+
+// WaitFor waits up to timeout for a metric, event title or service check called name that has all of tags.
+// The client buffers metrics, so call Flush on it first to avoid waiting for its flush interval. It reports
+// whether one was received.
+func (s *DogStatsDServer) WaitFor(name string, timeout time.Duration, tags ...string) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		found := s.received(name, tags)
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if found {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// Close stops the server. It is called automatically when the test ends.
+func (s *DogStatsDServer) Close() {
+	if s.conn.Close() == nil {
+		<-s.done
+	}
+}
+
+// received reports whether anything called name with all of tags has been received. It must be called with
+// the lock held.
+func (s *DogStatsDServer) received(name string, tags []string) bool {
+	hasTags := func(received []string) bool {
+		for _, tag := range tags {
+			if !slices.Contains(received, tag) {
+				return false
+			}
+		}
+		return true
+	}
+	return slices.ContainsFunc(s.metrics, func(m DogStatsDMetric) bool { return m.Name == name && hasTags(m.Tags) }) ||
+		slices.ContainsFunc(s.events, func(e StatsDEvent) bool { return e.Title == name && hasTags(e.Tags) }) ||
+		slices.ContainsFunc(s.serviceChecks, func(sc StatsDServiceCheck) bool { return sc.Name == name && hasTags(sc.Tags) })
+}
+
+func (s *DogStatsDServer) serve() {
+	defer close(s.done)
+	buf := make([]byte, dogStatsDMaxPacketSize)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.t.Error("failed to read DogStatsD packet ", err)
+			}
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line == "" {
+				continue
+			}
+			if err := s.receive(line); err != nil {
+				s.t.Errorf("failed to parse DogStatsD line %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func (s *DogStatsDServer) receive(line string) error {
+	switch {
+	case strings.HasPrefix(line, "_e{"):
+		event, err := parseDogStatsDEvent(line)
+		if err != nil {
+			return err
+		}
+		s.record(func() { s.events = append(s.events, event) })
+	case strings.HasPrefix(line, "_sc|"):
+		check, err := parseDogStatsDServiceCheck(line)
+		if err != nil {
+			return err
+		}
+		s.record(func() { s.serviceChecks = append(s.serviceChecks, check) })
+	default:
+		metrics, err := parseDogStatsDMetrics(line)
+		if err != nil {
+			return err
+		}
+		s.record(func() { s.metrics = append(s.metrics, metrics...) })
+	}
+	return nil
+}
+
+// record calls add with the lock held and wakes up anything waiting in WaitFor
+func (s *DogStatsDServer) record(add func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	add()
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// parseDogStatsDMetrics parses name:value[:value...]|type[|@rate][|#tags][|c:container][|Ttimestamp]
+func parseDogStatsDMetrics(line string) ([]DogStatsDMetric, error) {
+	fields := strings.Split(line, "|")
+	name, values, ok := strings.Cut(fields[0], ":")
+	if !ok || len(fields) < 2 {
+		return nil, errors.New("missing value or type")
+	}
+	template := DogStatsDMetric{Name: name, Type: fields[1], SampleRate: 1}
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sample rate: %w", err)
+			}
+			template.SampleRate = rate
+		case strings.HasPrefix(field, "#"):
+			template.Tags = strings.Split(field[1:], ",")
+		}
+	}
+
+	if template.Type == "s" {
+		template.Text = values
+		return []DogStatsDMetric{template}, nil
+	}
+	var metrics []DogStatsDMetric
+	for _, value := range strings.Split(values, ":") {
+		m := template
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value: %w", err)
+		}
+		m.Value = v
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// parseDogStatsDEvent parses _e{title length,text length}:title|text[|d:timestamp][|h:host][|k:key][|p:priority]
+// [|s:source][|t:alert type][|#tags][|c:container]
+func parseDogStatsDEvent(line string) (StatsDEvent, error) {
+	var event StatsDEvent
+	header, rest, ok := strings.Cut(line[len("_e{"):], "}:")
+	if !ok {
+		return event, errors.New("missing header")
+	}
+	titleLen, textLen, ok := strings.Cut(header, ",")
+	if !ok {
+		return event, errors.New("invalid header")
+	}
+	titleLength, err := strconv.Atoi(titleLen)
+	if err != nil {
+		return event, fmt.Errorf("invalid title length: %w", err)
+	}
+	textLength, err := strconv.Atoi(textLen)
+	if err != nil {
+		return event, fmt.Errorf("invalid text length: %w", err)
+	}
+	if len(rest) < titleLength+1+textLength {
+		return event, errors.New("title and text are shorter than the header says")
+	}
+	event.Title = rest[:titleLength]
+	event.Text = strings.ReplaceAll(rest[titleLength+1:titleLength+1+textLength], `\n`, "\n")
+
+	for _, field := range strings.Split(rest[titleLength+1+textLength:], "|")[1:] {
+		key, value, _ := strings.Cut(field, ":")
+		switch {
+		case strings.HasPrefix(field, "#"):
+			event.Tags = strings.Split(field[1:], ",")
+		case key == "d":
+			timestamp, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return event, fmt.Errorf("invalid timestamp: %w", err)
+			}
+			event.Timestamp = time.Unix(timestamp, 0)
+		case key == "h":
+			event.Hostname = value
+		case key == "k":
+			event.AggregationKey = value
+		case key == "p":
+			event.Priority = EventPriority(value)
+		case key == "s":
+			event.SourceTypeName = value
+		case key == "t":
+			event.AlertType = EventAlertType(value)
+		}
+	}
+	return event, nil
+}
+
+// parseDogStatsDServiceCheck parses _sc|name|status[|d:timestamp][|h:host][|#tags][|m:message][|c:container]
+func parseDogStatsDServiceCheck(line string) (StatsDServiceCheck, error) {
+	var check StatsDServiceCheck
+	fields := strings.Split(line, "|")
+	if len(fields) < 3 {
+		return check, errors.New("missing name or status")
+	}
+	status, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return check, fmt.Errorf("invalid status: %w", err)
+	}
+	check.Name, check.Status = fields[1], ServiceCheckStatus(status)
+
+	for _, field := range fields[3:] {
+		key, value, _ := strings.Cut(field, ":")
+		switch {
+		case strings.HasPrefix(field, "#"):
+			check.Tags = strings.Split(field[1:], ",")
+		case key == "d":
+			timestamp, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return check, fmt.Errorf("invalid timestamp: %w", err)
+			}
+			check.Timestamp = time.Unix(timestamp, 0)
+		case key == "h":
+			check.Hostname = value
+		case key == "m":
+			check.Message = strings.NewReplacer(`\n`, "\n", `m\:`, "m:").Replace(value)
+		}
+	}
+	return check, nil
+}
@@ -0,0 +1,98 @@
+package tools
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDogStatsDServer(t *testing.T) {
+
+	servers := map[string]func(testing.TB) *DogStatsDServer{
+		"UDP": NewDogStatsDServer,
+		"UDS": NewDogStatsDUDSServer,
+	}
+	for transport, newServer := range servers {
+		t.Run("should receive metrics from NewStatsD over "+transport, func(t *testing.T) {
+			server := newServer(t)
+			sd, err := NewStatsD(NewStatsDConfig(true, &MockLogger{},
+				WithAddress(server.Address()), WithNamespace("search."), WithGlobalTags("team:data")))
+			if err != nil {
+				t.Fatal("failed to create StatsD ", err)
+			}
+			defer sd.Close()
+
+			sd.Incr("queries", "index:a")
+			sd.Histogram("query_time_ms", 12.5, "index:a")
+			assert.NoError(t, sd.Flush())
+
+			assert.True(t, server.WaitFor("search.queries", 5*time.Second, "index:a", "team:data", "env:local"))
+			assert.True(t, server.WaitFor("search.query_time_ms", 5*time.Second))
+			assert.Equal(t, []DogStatsDMetric{{
+				Name:       "search.query_time_ms",
+				Value:      12.5,
+				Type:       "h",
+				SampleRate: 1,
+				Tags:       []string{"env:local", "component:a-service-has-no-name", "team:data", "index:a"},
+			}}, server.MetricsNamed("search.query_time_ms"))
+		})
+	}
+
+	t.Run("should receive events and service checks", func(t *testing.T) {
+		server := NewDogStatsDServer(t)
+		sd, _ := NewStatsD(NewStatsDConfig(true, &MockLogger{}, WithAddress(server.Address())))
+		defer sd.Close()
+
+		sd.Event(&StatsDEvent{
+			Title:     "Deployed",
+			Text:      "Version 1.2\nwith fixes",
+			Priority:  EventPriorityLow,
+			AlertType: EventAlertSuccess,
+			Tags:      []string{"version:1.2"},
+		})
+		sd.ServiceCheck(&StatsDServiceCheck{Name: "search.index", Status: ServiceCheckWarning, Message: "slow: 2s"})
+		assert.NoError(t, sd.Flush())
+
+		assert.True(t, server.WaitFor("Deployed", 5*time.Second))
+		assert.True(t, server.WaitFor("search.index", 5*time.Second))
+		event := server.Events()[0]
+		assert.Equal(t, "Version 1.2\nwith fixes", event.Text)
+		assert.Equal(t, EventPriorityLow, event.Priority)
+		assert.Equal(t, EventAlertSuccess, event.AlertType)
+		assert.Contains(t, event.Tags, "version:1.2")
+		check := server.ServiceChecks()[0]
+		assert.Equal(t, ServiceCheckWarning, check.Status)
+		assert.Equal(t, "slow: 2s", check.Message)
+	})
+
+	t.Run("should parse lines with several values and sets", func(t *testing.T) {
+		metrics, err := parseDogStatsDMetrics("app.latency:1:2.5|d|@0.5|#route:/a|c:ci-123")
+		assert.NoError(t, err)
+		assert.Equal(t, []DogStatsDMetric{
+			{Name: "app.latency", Value: 1, Type: "d", SampleRate: 0.5, Tags: []string{"route:/a"}},
+			{Name: "app.latency", Value: 2.5, Type: "d", SampleRate: 0.5, Tags: []string{"route:/a"}},
+		}, metrics)
+
+		metrics, err = parseDogStatsDMetrics("app.users:user-1|s")
+		assert.NoError(t, err)
+		assert.Equal(t, []DogStatsDMetric{{Name: "app.users", Text: "user-1", Type: "s", SampleRate: 1}}, metrics)
+
+		_, err = parseDogStatsDMetrics("app.broken")
+		assert.Error(t, err)
+	})
+
+	t.Run("should forget everything on reset", func(t *testing.T) {
+		server := NewDogStatsDServer(t)
+		sd, _ := NewStatsD(NewStatsDConfig(true, &MockLogger{}, WithAddress(server.Address())))
+		defer sd.Close()
+		sd.Incr("queries")
+		assert.NoError(t, sd.Flush())
+		assert.True(t, server.WaitFor("app.queries", 5*time.Second))
+
+		server.Reset()
+
+		assert.Empty(t, server.Metrics())
+		assert.False(t, server.WaitFor("app.queries", 10*time.Millisecond))
+	})
+}
@@ -0,0 +1,185 @@
+package tools
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	hedgeLatencySamples    = 1000
+	hedgeMinLatencySamples = 20
+)
+
+// HedgingConfig configures hedged requests. Set Delay, Percentile or both.
+type HedgingConfig struct {
+	// Delay is how long to wait for a response before sending the hedge. It is used until there are enough
+	// response times for Percentile.
+	Delay time.Duration
+	// Percentile, between 0 and 100, of recent response times to wait for before sending the hedge, e.g. 95
+	// to hedge the slowest 5% of requests. Values over 100 are treated as 100.
+	Percentile float64
+}
+
+// WithHedging sends a second, identical request when a GET or HEAD request without a body hasn't had a
+// response after a delay, and uses whichever response comes back first without failing. The other request
+// is cancelled. This cuts tail latency for read-heavy downstreams at the cost of a few extra requests.
+// A hedge takes a token from the rate limiter and a slot from the adaptive limiter like any other request, and
+// isn't sent when either is unavailable. Hedges sent are counted in http_client.hedge_fired, hedges that won in
+// http_client.hedge_won and hedges that weren't sent because of a limiter in http_client.hedge_skipped.
+func WithHedging(config HedgingConfig) HTTPClientOption {
+	config.Percentile = min(config.Percentile, 100)
+	return func(thc *httpClientWithStats) {
+		thc.hedger = &hedger{config: config}
+	}
+}
+
+type hedger struct {
+	config HedgingConfig
+
+	mu        sync.Mutex
+	latencies []float64
+	next      int
+}
+
+type hedgeAttempt struct {
+	id    int
+	resp  *http.Response
+	err   error
+	hedge bool
+}
+
+func (a hedgeAttempt) succeeded() bool {
+	return a.err == nil && a.resp.StatusCode < http.StatusInternalServerError
+}
+
+// do sends r with the client of thc, and a hedge if r is idempotent and there isn't a response in time. The
+// response time of r is recorded from when the first attempt was sent, whichever attempt wins, so the slow
+// attempts that lose and are cancelled still count towards the percentile.
+func (h *hedger) do(thc *httpClientWithStats, r *http.Request, statsd StatsD, tags []string) (*http.Response, error) {
+	if !isHedgeable(r) {
+		return thc.httpClient.Do(r)
+	}
+
+	start := thc.clock.Now()
+	var hedgeTimer <-chan time.Time
+	if delay, ok := h.delay(); ok {
+		hedgeTimer = thc.clock.After(delay)
+	}
+	results := make(chan hedgeAttempt, 2)
+	cancels := []context.CancelFunc{h.send(thc, r, 0, false, results, nil)}
+
+	inFlight := 1
+	for {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			release, ok := thc.acquireHedge(r, tags)
+			if !ok {
+				statsd.Incr(HttpClientHedgeSkippedKey, tags...)
+				continue
+			}
+			inFlight++
+			statsd.Incr(HttpClientHedgeFiredKey, tags...)
+			cancels = append(cancels, h.send(thc, r, len(cancels), true, results, release))
+		case a := <-results:
+			inFlight--
+			if !a.succeeded() && inFlight > 0 {
+				discardAttempt(a)
+				continue
+			}
+			if a.succeeded() {
+				h.record(thc.clock.Now().Sub(start))
+			}
+			if a.hedge && a.succeeded() {
+				statsd.Incr(HttpClientHedgeWonKey, tags...)
+			}
+			for id, cancel := range cancels {
+				if id != a.id {
+					cancel()
+				}
+			}
+			go func(remaining int) {
+				for ; remaining > 0; remaining-- {
+					discardAttempt(<-results)
+				}
+			}(inFlight)
+			return a.resp, a.err
+		}
+	}
+}
+
+// send makes one attempt at r in the background. The attempt is cancelled when its response body is closed
+// or the returned func is called. release, if not nil, is called with the outcome once there is a response.
+func (h *hedger) send(thc *httpClientWithStats, r *http.Request, id int, hedge bool, results chan<- hedgeAttempt, release func(success bool)) context.CancelFunc {
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		resp, err := thc.httpClient.Do(r.Clone(ctx))
+		if release != nil {
+			// Cancelling the request that lost isn't a failure of the downstream
+			release(limiterSuccess(resp, err) || ctx.Err() != nil)
+		}
+		a := hedgeAttempt{id: id, resp: resp, err: err, hedge: hedge}
+		if err == nil {
+			resp.Body = &cancelOnClose{resp.Body, cancel}
+		} else {
+			cancel()
+		}
+		results <- a
+	}()
+	return cancel
+}
+
+// delay returns how long to wait before sending a hedge, and false if no hedge should be sent
+func (h *hedger) delay() (time.Duration, bool) {
+	if h.config.Percentile > 0 {
+		h.mu.Lock()
+		sorted := append([]float64{}, h.latencies...)
+		h.mu.Unlock()
+		if len(sorted) >= hedgeMinLatencySamples {
+			sort.Float64s(sorted)
+			return time.Duration(percentile(sorted, h.config.Percentile) * float64(time.Millisecond)), true
+		}
+	}
+	return h.config.Delay, h.config.Delay > 0
+}
+
+// record keeps the response time of the last few successful requests for the percentile delay
+func (h *hedger) record(latency time.Duration) {
+	if h.config.Percentile <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.latencies) < hedgeLatencySamples {
+		h.latencies = append(h.latencies, durationInMs(latency))
+		return
+	}
+	h.latencies[h.next] = durationInMs(latency)
+	h.next = (h.next + 1) % hedgeLatencySamples
+}
+
+func isHedgeable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && (r.Body == nil || r.Body == http.NoBody)
+}
+
+func discardAttempt(a hedgeAttempt) {
+	if a.resp != nil {
+		a.resp.Body.Close()
+	}
+}
+
+// cancelOnClose cancels the context of a request when its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,335 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHedgingClient(msd *MockStatsD, config HedgingConfig, opts ...HTTPClientOption) (HTTPClientWithStats, *fakeClock) {
+	fc := newFakeClock(0)
+	hc := NewHTTPClientWithStats(http.DefaultClient, msd, append(opts, WithHedging(config))...)
+	hc.(*httpClientWithStats).clock = fc
+	return hc, fc
+}
+
+func TestHedging(t *testing.T) {
+
+	t.Run("should use the hedge and cancel the first request when it is slow", func(t *testing.T) {
+		var requests atomic.Int32
+		arrived, cancelled := make(chan struct{}), make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) == 1 {
+				close(arrived)
+				<-r.Context().Done()
+				close(cancelled)
+				return
+			}
+			fmt.Fprint(w, "hedge")
+		}))
+		defer ts.Close()
+		msd := &MockStatsD{}
+		hc, fc := newTestHedgingClient(msd, HedgingConfig{Delay: 10 * time.Millisecond})
+		go func() {
+			<-arrived
+			fc.Advance(10 * time.Millisecond)
+		}()
+
+		resp, err := hc.Get(ts.URL)
+
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "hedge", string(body))
+		assert.Equal(t, int32(2), requests.Load())
+		msd.AssertCount(t, HttpClientHedgeFiredKey, 1, "method:GET")
+		msd.AssertCount(t, HttpClientHedgeWonKey, 1, "method:GET")
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Error("the first request was not cancelled")
+		}
+	})
+
+	t.Run("should not hedge a request that responds in time", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			requests.Add(1)
+			fmt.Fprint(w, "ok")
+		}))
+		defer ts.Close()
+		msd := &MockStatsD{}
+		hc, _ := newTestHedgingClient(msd, HedgingConfig{Delay: 10 * time.Millisecond})
+
+		resp, err := hc.Get(ts.URL)
+
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "ok", string(body))
+		assert.Equal(t, int32(1), requests.Load())
+		msd.AssertNotCalled(t, HttpClientHedgeFiredKey)
+	})
+
+	t.Run("should keep the first response when it wins after the hedge is sent", func(t *testing.T) {
+		var requests atomic.Int32
+		arrived, hedged := make(chan struct{}), make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) == 1 {
+				close(arrived)
+				<-hedged
+				fmt.Fprint(w, "first")
+				return
+			}
+			close(hedged)
+			<-r.Context().Done()
+		}))
+		defer ts.Close()
+		msd := &MockStatsD{}
+		hc, fc := newTestHedgingClient(msd, HedgingConfig{Delay: 10 * time.Millisecond})
+		go func() {
+			<-arrived
+			fc.Advance(10 * time.Millisecond)
+		}()
+
+		resp, err := hc.Get(ts.URL)
+
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "first", string(body))
+		msd.AssertCount(t, HttpClientHedgeFiredKey, 1)
+		msd.AssertNotCalled(t, HttpClientHedgeWonKey)
+	})
+
+	t.Run("should wait for the hedge when the first request fails", func(t *testing.T) {
+		var requests atomic.Int32
+		arrived, hedged := make(chan struct{}), make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			if requests.Add(1) == 1 {
+				close(arrived)
+				<-hedged
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			close(hedged)
+			fmt.Fprint(w, "hedge")
+		}))
+		defer ts.Close()
+		msd := &MockStatsD{}
+		hc, fc := newTestHedgingClient(msd, HedgingConfig{Delay: 10 * time.Millisecond})
+		go func() {
+			<-arrived
+			fc.Advance(10 * time.Millisecond)
+		}()
+
+		resp, err := hc.Get(ts.URL)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+		msd.AssertCount(t, HttpClientHedgeWonKey, 1)
+	})
+
+	t.Run("should return a failure without hedging when it comes before the delay", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer ts.Close()
+		msd := &MockStatsD{}
+		hc, _ := newTestHedgingClient(msd, HedgingConfig{Delay: 10 * time.Millisecond})
+
+		resp, err := hc.Get(ts.URL)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		resp.Body.Close()
+		assert.Equal(t, int32(1), requests.Load())
+		msd.AssertNotCalled(t, HttpClientHedgeFiredKey)
+	})
+
+	t.Run("should not hedge requests that aren't idempotent", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			requests.Add(1)
+		}))
+		defer ts.Close()
+		msd := &MockStatsD{}
+		hc, _ := newTestHedgingClient(msd, HedgingConfig{Delay: time.Millisecond})
+
+		resp, err := hc.Post(ts.URL, "text/plain", strings.NewReader("body"))
+
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, int32(1), requests.Load())
+		msd.AssertNotCalled(t, HttpClientHedgeFiredKey)
+	})
+
+	t.Run("should not hedge without a rate limit token or a limiter slot", func(t *testing.T) {
+		rateLimiter, _ := newTestRateLimiter(t, 1, 1)
+		adaptiveLimiter, _ := NewAdaptiveLimiter("test", AdaptiveLimiterConfig{InitialLimit: 1, MaxLimit: 1}, &MockStatsD{})
+		limiters := map[string]HTTPClientOption{"rate limiter": WithRateLimiter(rateLimiter), "adaptive limiter": WithAdaptiveLimiter(adaptiveLimiter)}
+		for name, limiter := range limiters {
+			var requests atomic.Int32
+			arrived, skipped := make(chan struct{}), make(chan struct{})
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				requests.Add(1)
+				close(arrived)
+				<-skipped
+				fmt.Fprint(w, "first")
+			}))
+			msd := &MockStatsD{}
+			hc, fc := newTestHedgingClient(msd, HedgingConfig{Delay: 10 * time.Millisecond}, limiter)
+			go func() {
+				<-arrived
+				fc.Advance(10 * time.Millisecond)
+				msd.AssertEventually(t, HttpClientHedgeSkippedKey, 5*time.Second, "method:GET")
+				close(skipped)
+			}()
+
+			resp, err := hc.Get(ts.URL)
+
+			assert.NoError(t, err, name)
+			resp.Body.Close()
+			ts.Close()
+			assert.Equal(t, int32(1), requests.Load(), name)
+			msd.AssertNotCalled(t, HttpClientHedgeFiredKey)
+			assert.Equal(t, 0, adaptiveLimiter.InFlight(), name)
+		}
+	})
+
+	t.Run("should release the limiter slot of a hedge", func(t *testing.T) {
+		arrived := make(chan struct{})
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) == 1 {
+				close(arrived)
+				<-r.Context().Done()
+				return
+			}
+			fmt.Fprint(w, "hedge")
+		}))
+		defer ts.Close()
+		limiter, _ := NewAdaptiveLimiter("test", AdaptiveLimiterConfig{InitialLimit: 2, MaxLimit: 2}, &MockStatsD{})
+		msd := &MockStatsD{}
+		hc, fc := newTestHedgingClient(msd, HedgingConfig{Delay: 10 * time.Millisecond}, WithAdaptiveLimiter(limiter))
+		go func() {
+			<-arrived
+			fc.Advance(10 * time.Millisecond)
+		}()
+
+		resp, err := hc.Get(ts.URL)
+
+		assert.NoError(t, err)
+		resp.Body.Close()
+		msd.AssertCount(t, HttpClientHedgeWonKey, 1)
+		assert.Eventually(t, func() bool { return limiter.InFlight() == 0 }, 5*time.Second, time.Millisecond)
+		assert.Equal(t, 2, limiter.Limit())
+	})
+
+	t.Run("should record the response time of a hedged request from its first attempt", func(t *testing.T) {
+		var requests atomic.Int32
+		arrived := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) == 1 {
+				close(arrived)
+				<-r.Context().Done()
+				return
+			}
+			fmt.Fprint(w, "hedge")
+		}))
+		defer ts.Close()
+		hc, fc := newTestHedgingClient(&MockStatsD{}, HedgingConfig{Delay: 10 * time.Millisecond, Percentile: 50})
+		go func() {
+			<-arrived
+			fc.Advance(10 * time.Millisecond)
+		}()
+
+		resp, err := hc.Get(ts.URL)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		h := hc.(*httpClientWithStats).hedger
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		assert.Equal(t, []float64{10}, h.latencies, "the cancelled first attempt took at least as long as the hedge took to win")
+	})
+
+	t.Run("should record response times from the client's clock", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+		defer ts.Close()
+		hc, _ := newTestHedgingClient(&MockStatsD{}, HedgingConfig{Percentile: 50})
+		hc.(*httpClientWithStats).clock = newFakeClock(40 * time.Millisecond)
+
+		for i := 0; i < hedgeMinLatencySamples; i++ {
+			resp, err := hc.Get(ts.URL)
+			assert.NoError(t, err)
+			resp.Body.Close()
+		}
+
+		delay, ok := hc.(*httpClientWithStats).hedger.delay()
+		assert.True(t, ok)
+		assert.Equal(t, 40*time.Millisecond, delay)
+	})
+}
+
+func TestHedger_Delay(t *testing.T) {
+
+	t.Run("should not hedge without a delay or percentile", func(t *testing.T) {
+		h := &hedger{}
+		_, ok := h.delay()
+		assert.False(t, ok)
+	})
+
+	t.Run("should use the delay until there are enough response times", func(t *testing.T) {
+		h := &hedger{config: HedgingConfig{Delay: 50 * time.Millisecond, Percentile: 90}}
+		for i := 1; i < hedgeMinLatencySamples; i++ {
+			h.record(time.Duration(i) * time.Millisecond)
+		}
+		delay, ok := h.delay()
+		assert.True(t, ok)
+		assert.Equal(t, 50*time.Millisecond, delay)
+	})
+
+	t.Run("should use the percentile of recent response times", func(t *testing.T) {
+		h := &hedger{config: HedgingConfig{Percentile: 90}}
+		for i := 1; i <= 100; i++ {
+			h.record(time.Duration(i) * time.Millisecond)
+		}
+		delay, ok := h.delay()
+		assert.True(t, ok)
+		assert.Equal(t, 90*time.Millisecond, delay)
+	})
+
+	t.Run("should treat percentiles over 100 as 100", func(t *testing.T) {
+		thc := &httpClientWithStats{}
+		WithHedging(HedgingConfig{Percentile: 150})(thc)
+		for i := 1; i <= 100; i++ {
+			thc.hedger.record(time.Duration(i) * time.Millisecond)
+		}
+		delay, ok := thc.hedger.delay()
+		assert.True(t, ok)
+		assert.Equal(t, 100*time.Millisecond, delay)
+	})
+
+	t.Run("should only keep the most recent response times", func(t *testing.T) {
+		h := &hedger{config: HedgingConfig{Percentile: 50}}
+		for i := 0; i < hedgeLatencySamples; i++ {
+			h.record(time.Second)
+		}
+		for i := 0; i < hedgeLatencySamples; i++ {
+			h.record(time.Millisecond)
+		}
+		delay, _ := h.delay()
+		assert.Equal(t, time.Millisecond, delay)
+	})
+}
@@ -0,0 +1,499 @@
+package tools
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a response kept in an HTTPCacheStore. It must not be modified once it has been stored.
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// VaryHeader has the request headers named by the response's Vary header, which a request must match to
+	// use the response
+	VaryHeader http.Header
+	// RequestTime is when the request was sent and ResponseTime is when the response was received
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// HTTPCacheStore keeps the responses cached by the HTTP client. It must be safe for concurrent use.
+type HTTPCacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, response *CachedResponse)
+	Delete(key string)
+}
+
+// SizeLimitedHTTPCacheStore is an HTTPCacheStore that can't hold response bodies over MaxResponseSize bytes.
+// The cache stops reading a bigger response into memory and passes it through without caching it. Stores that
+// don't implement it are limited to 10MB.
+type SizeLimitedHTTPCacheStore interface {
+	HTTPCacheStore
+	MaxResponseSize() int64
+}
+
+const (
+	defaultMaxCachedResponseSize = 10 << 20
+	defaultCacheStoreSize        = 64 << 20
+)
+
+// WithCache caches responses to GET requests in store, following the Cache-Control, Expires, ETag and
+// Last-Modified headers like a private browser cache. Responses are only cached when they have an expiry or a
+// validator. Responses to requests with an Authorization header are only cached when the response is marked
+// public, s-maxage or must-revalidate, as a shared cache would, since the key doesn't include the credentials.
+// Stale responses are revalidated with If-None-Match and If-Modified-Since, or served while they
+// are revalidated in the background when they have a stale-while-revalidate directive. A nil store is replaced
+// with an in-memory store from NewLRUCacheStore that holds up to 64MB.
+func WithCache(store HTTPCacheStore) HTTPClientOption {
+	if store == nil {
+		store = NewLRUCacheStore(defaultCacheStoreSize)
+	}
+	maxResponseSize := int64(defaultMaxCachedResponseSize)
+	if limited, ok := store.(SizeLimitedHTTPCacheStore); ok {
+		maxResponseSize = limited.MaxResponseSize()
+	}
+	return func(thc *httpClientWithStats) {
+		thc.cache = &httpCache{store: store, clock: &timeClock{}, maxResponseSize: maxResponseSize}
+	}
+}
+
+type httpCache struct {
+	store           HTTPCacheStore
+	clock           clock
+	maxResponseSize int64
+	// revalidating has the keys being revalidated in the background, so each is only revalidated once at a time
+	revalidating sync.Map
+}
+
+// cacheableStatusCodes are the status codes that can be cached by default, see RFC 9110 section 15.1
+var cacheableStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// do answers r from the cache when it can, and otherwise sends it with send and caches the response
+func (c *httpCache) do(r *http.Request, statsd StatsD, tags []string, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if r.Method != http.MethodGet {
+		resp, err := send(r)
+		if err == nil && !isSafeMethod(r.Method) && resp.StatusCode < http.StatusBadRequest {
+			c.store.Delete(cacheKey(r))
+		}
+		return resp, err
+	}
+	requestCC := parseCacheControl(r.Header)
+	if _, ok := requestCC["no-store"]; ok || r.Header.Get("Range") != "" ||
+		r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return send(r)
+	}
+
+	key := cacheKey(r)
+	cached, ok := c.store.Get(key)
+	if !ok || !cached.matches(r) {
+		statsd.Incr(HttpClientCacheMissKey, tags...)
+		return c.fetch(r, key, send)
+	}
+
+	age := cached.age(c.clock.Now())
+	responseCC := parseCacheControl(cached.Header)
+	lifetime := cached.freshnessLifetime(responseCC)
+	if isFresh(age, lifetime, requestCC) {
+		statsd.Incr(HttpClientCacheHitKey, append(tags, "cache_status:fresh")...)
+		return cached.response(r, age), nil
+	}
+	if canServeStale(age, lifetime, requestCC, responseCC) && cached.hasValidator() {
+		statsd.Incr(HttpClientCacheHitKey, append(tags, "cache_status:stale")...)
+		c.revalidateInBackground(r, key, cached, statsd, tags, send)
+		return cached.response(r, age), nil
+	}
+	if !cached.hasValidator() {
+		statsd.Incr(HttpClientCacheMissKey, tags...)
+		return c.fetch(r, key, send)
+	}
+	return c.revalidate(r, key, cached, statsd, tags, send)
+}
+
+// fetch sends r and caches the response if it can be
+func (c *httpCache) fetch(r *http.Request, key string, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	requestTime := c.clock.Now()
+	resp, err := send(r)
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err = c.save(r, key, requestTime, resp)
+	return resp, err
+}
+
+// revalidate asks the server whether cached is still valid, using the cached response if it is
+func (c *httpCache) revalidate(r *http.Request, key string, cached *CachedResponse, statsd StatsD, tags []string, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	conditional := r.Clone(r.Context())
+	if etag := cached.Header.Get("ETag"); etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	requestTime := c.clock.Now()
+	resp, err := send(conditional)
+	if err != nil {
+		statsd.Incr(HttpClientCacheRevalidationKey, append(tags, "cache_result:error")...)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		statsd.Incr(HttpClientCacheRevalidationKey, append(tags, "cache_result:modified")...)
+		resp, stored, err := c.save(r, key, requestTime, resp)
+		if !stored {
+			// The cached response is out of date, so it mustn't be used again
+			c.store.Delete(key)
+		}
+		return resp, err
+	}
+	resp.Body.Close()
+	statsd.Incr(HttpClientCacheRevalidationKey, append(tags, "cache_result:not_modified")...)
+
+	updated := cached.update(resp.Header, requestTime, c.clock.Now())
+	c.store.Set(key, updated)
+	return updated.response(r, updated.age(c.clock.Now())), nil
+}
+
+// revalidateInBackground revalidates cached without waiting for the result, unless it is already being
+// revalidated
+func (c *httpCache) revalidateInBackground(r *http.Request, key string, cached *CachedResponse, statsd StatsD, tags []string, send func(*http.Request) (*http.Response, error)) {
+	if _, revalidating := c.revalidating.LoadOrStore(key, struct{}{}); revalidating {
+		return
+	}
+	r = r.Clone(context.WithoutCancel(r.Context()))
+	go func() {
+		defer c.revalidating.Delete(key)
+		resp, err := c.revalidate(r, key, cached, statsd, tags, send)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+}
+
+// save stores resp if it can be cached. The body is read into memory so it can be, and replaced with a copy.
+// Reading stops once the body is bigger than the store can hold, and the rest is streamed to the caller. It
+// reports whether resp was stored.
+func (c *httpCache) save(r *http.Request, key string, requestTime time.Time, resp *http.Response) (*http.Response, bool, error) {
+	if !isStorable(r, resp) || resp.ContentLength > c.maxResponseSize {
+		return resp, false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.maxResponseSize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, false, err
+	}
+	if int64(len(body)) > c.maxResponseSize {
+		resp.Body = &readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, false, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	c.store.Set(key, &CachedResponse{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+		VaryHeader:   varyHeader(r, resp.Header),
+		RequestTime:  requestTime,
+		ResponseTime: c.clock.Now(),
+	})
+	return resp, true, nil
+}
+
+// age is how old cr is at now, see RFC 9111 section 4.2.3
+func (cr *CachedResponse) age(now time.Time) time.Duration {
+	var apparentAge, ageValue time.Duration
+	if date, err := http.ParseTime(cr.Header.Get("Date")); err == nil {
+		apparentAge = max(cr.ResponseTime.Sub(date), 0)
+	}
+	if seconds, err := strconv.Atoi(cr.Header.Get("Age")); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	correctedAge := ageValue + cr.ResponseTime.Sub(cr.RequestTime)
+	return max(apparentAge, correctedAge) + now.Sub(cr.ResponseTime)
+}
+
+// freshnessLifetime is how long cr is fresh for, from max-age or Expires. Responses without either, or with
+// no-cache, are never fresh and are revalidated every time.
+func (cr *CachedResponse) freshnessLifetime(cc map[string]string) time.Duration {
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if maxAge, ok := directiveSeconds(cc, "max-age"); ok {
+		return maxAge
+	}
+	expires, err := http.ParseTime(cr.Header.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(cr.Header.Get("Date"))
+	if err != nil {
+		date = cr.ResponseTime
+	}
+	return max(expires.Sub(date), 0)
+}
+
+func (cr *CachedResponse) hasValidator() bool {
+	return cr.Header.Get("ETag") != "" || cr.Header.Get("Last-Modified") != ""
+}
+
+// matches reports whether r has the same values as the cached request for the headers named by Vary
+func (cr *CachedResponse) matches(r *http.Request) bool {
+	for name, values := range cr.VaryHeader {
+		if !slices.Equal(r.Header.Values(name), values) {
+			return false
+		}
+	}
+	return true
+}
+
+// update returns a copy of cr with the headers of a 304 Not Modified response for it
+func (cr *CachedResponse) update(header http.Header, requestTime, responseTime time.Time) *CachedResponse {
+	updated := *cr
+	updated.Header = cr.Header.Clone()
+	for name, values := range header {
+		if name != "Content-Length" {
+			updated.Header[name] = values
+		}
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	return &updated
+}
+
+// response makes a response to r from cr
+func (cr *CachedResponse) response(r *http.Request, age time.Duration) *http.Response {
+	header := cr.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", cr.StatusCode, http.StatusText(cr.StatusCode)),
+		StatusCode:    cr.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(cr.Body)),
+		ContentLength: int64(len(cr.Body)),
+		Request:       r,
+	}
+}
+
+func isFresh(age, lifetime time.Duration, requestCC map[string]string) bool {
+	if _, ok := requestCC["no-cache"]; ok {
+		return false
+	}
+	if maxAge, ok := directiveSeconds(requestCC, "max-age"); ok && age > maxAge {
+		return false
+	}
+	return age < lifetime
+}
+
+// canServeStale reports whether a stale response is within its stale-while-revalidate window, and neither
+// the request nor the response insist on it being revalidated first
+func canServeStale(age, lifetime time.Duration, requestCC, responseCC map[string]string) bool {
+	for _, directive := range []string{"no-cache", "max-age"} {
+		if _, ok := requestCC[directive]; ok {
+			return false
+		}
+	}
+	if _, ok := responseCC["must-revalidate"]; ok {
+		return false
+	}
+	staleWhileRevalidate, ok := directiveSeconds(responseCC, "stale-while-revalidate")
+	return ok && age < lifetime+staleWhileRevalidate
+}
+
+// isStorable reports whether resp to r can be cached, and is worth caching because it has an expiry or a
+// validator. Responses to authorised requests need explicit permission, see RFC 9111 section 3.5.
+func isStorable(r *http.Request, resp *http.Response) bool {
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok || !cacheableStatusCodes[resp.StatusCode] {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !hasAnyDirective(cc, "public", "s-maxage", "must-revalidate") {
+		return false
+	}
+	for _, name := range headerList(resp.Header, "Vary") {
+		if name == "*" {
+			return false
+		}
+	}
+	_, hasMaxAge := cc["max-age"]
+	return hasMaxAge || resp.Header.Get("Expires") != "" || resp.Header.Get("ETag") != "" ||
+		resp.Header.Get("Last-Modified") != ""
+}
+
+func hasAnyDirective(cc map[string]string, directives ...string) bool {
+	for _, directive := range directives {
+		if _, ok := cc[directive]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions ||
+		method == http.MethodTrace
+}
+
+func cacheKey(r *http.Request) string {
+	return r.URL.String()
+}
+
+// varyHeader returns the headers of r named by the Vary header of its response
+func varyHeader(r *http.Request, header http.Header) http.Header {
+	names := headerList(header, "Vary")
+	if len(names) == 0 {
+		return nil
+	}
+	vary := make(http.Header, len(names))
+	for _, name := range names {
+		vary[http.CanonicalHeaderKey(name)] = r.Header.Values(name)
+	}
+	return vary
+}
+
+// parseCacheControl returns the directives in the Cache-Control header, with lowercase names, mapped to their
+// unquoted values
+func parseCacheControl(header http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, directive := range headerList(header, "Cache-Control") {
+		name, value, _ := strings.Cut(directive, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return cc
+}
+
+func directiveSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// headerList returns the comma separated values of the header name
+func headerList(header http.Header, name string) []string {
+	var list []string
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+type lruCacheStore struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruCacheEntry struct {
+	key      string
+	response *CachedResponse
+	size     int64
+}
+
+// NewLRUCacheStore creates an in-memory HTTPCacheStore that holds up to maxBytes of responses, evicting the
+// least recently used ones to make room for new ones
+func NewLRUCacheStore(maxBytes int64) HTTPCacheStore {
+	return &lruCacheStore{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// MaxResponseSize is the size of the store, as no bigger response can fit in it
+func (s *lruCacheStore) MaxResponseSize() int64 {
+	return s.maxBytes
+}
+
+func (s *lruCacheStore) Get(key string) (*CachedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(element)
+	return element.Value.(*lruCacheEntry).response, true
+}
+
+func (s *lruCacheStore) Set(key string, response *CachedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	size := cachedResponseSize(key, response)
+	if size > s.maxBytes {
+		return
+	}
+	s.entries[key] = s.order.PushFront(&lruCacheEntry{key: key, response: response, size: size})
+	s.size += size
+	for s.size > s.maxBytes {
+		s.remove(s.order.Back().Value.(*lruCacheEntry).key)
+	}
+}
+
+func (s *lruCacheStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+}
+
+// remove deletes key. It must be called with the lock held.
+func (s *lruCacheStore) remove(key string) {
+	element, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	s.order.Remove(element)
+	delete(s.entries, key)
+	s.size -= element.Value.(*lruCacheEntry).size
+}
+
+// cachedResponseSize estimates the memory used by a cached response from the size of its key, body and headers
+func cachedResponseSize(key string, response *CachedResponse) int64 {
+	size := len(key) + len(response.Body)
+	for _, header := range []http.Header{response.Header, response.VaryHeader} {
+		for name, values := range header {
+			size += len(name)
+			for _, value := range values {
+				size += len(value)
+			}
+		}
+	}
+	return int64(size)
+}
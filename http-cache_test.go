@@ -0,0 +1,431 @@
+package tools
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCacheClient(store HTTPCacheStore) (HTTPClientWithStats, *MockStatsD, *fakeClock) {
+	msd := &MockStatsD{}
+	mc := newFakeClock(0)
+	hc := NewHTTPClientWithStats(http.DefaultClient, msd, WithCache(store))
+	hc.(*httpClientWithStats).cache.clock = mc
+	return hc, msd, mc
+}
+
+func getBody(t *testing.T, hc HTTPClientWithStats, url string, header ...string) (*http.Response, string) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := hc.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestHTTPCache(t *testing.T) {
+
+	t.Run("should serve fresh responses from the cache", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, "reference data")
+		}))
+		defer ts.Close()
+		hc, msd, mc := newTestCacheClient(NewLRUCacheStore(1 << 20))
+
+		_, body := getBody(t, hc, ts.URL)
+		assert.Equal(t, "reference data", body)
+		mc.Advance(30 * time.Second)
+		resp, body := getBody(t, hc, ts.URL)
+
+		assert.Equal(t, "reference data", body)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "30", resp.Header.Get("Age"))
+		assert.Equal(t, int32(1), requests.Load())
+		msd.AssertCount(t, HttpClientCacheMissKey, 1)
+		msd.AssertCount(t, HttpClientCacheHitKey, 1, "cache_status:fresh", "method:GET")
+	})
+
+	t.Run("should use an in-memory store when none is given", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, "reference data")
+		}))
+		defer ts.Close()
+		hc, _, _ := newTestCacheClient(nil)
+
+		getBody(t, hc, ts.URL)
+		_, body := getBody(t, hc, ts.URL)
+
+		assert.Equal(t, "reference data", body)
+		assert.Equal(t, int32(1), requests.Load())
+	})
+
+	t.Run("should revalidate stale responses with their ETag", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			// the Date would be a minute behind the test clock after it is advanced, which ages the response
+			w.Header()["Date"] = nil
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			io.WriteString(w, "reference data")
+		}))
+		defer ts.Close()
+		hc, msd, mc := newTestCacheClient(NewLRUCacheStore(1 << 20))
+
+		getBody(t, hc, ts.URL)
+		mc.Advance(61 * time.Second)
+		resp, body := getBody(t, hc, ts.URL)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "reference data", body)
+		assert.Equal(t, int32(2), requests.Load())
+		msd.AssertCount(t, HttpClientCacheRevalidationKey, 1, "cache_result:not_modified")
+
+		_, body = getBody(t, hc, ts.URL)
+		assert.Equal(t, "reference data", body)
+		assert.Equal(t, int32(2), requests.Load(), "the revalidated response should be fresh again")
+	})
+
+	t.Run("should replace stale responses that have been modified", func(t *testing.T) {
+		var version atomic.Int32
+		lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-Modified-Since") == lastModified && version.Load() == 0 {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Last-Modified", lastModified)
+			if version.Load() == 0 {
+				io.WriteString(w, "v1")
+				return
+			}
+			io.WriteString(w, "v2")
+		}))
+		defer ts.Close()
+		hc, msd, _ := newTestCacheClient(NewLRUCacheStore(1 << 20))
+
+		_, body := getBody(t, hc, ts.URL)
+		assert.Equal(t, "v1", body)
+		_, body = getBody(t, hc, ts.URL)
+		assert.Equal(t, "v1", body)
+		version.Store(1)
+		_, body = getBody(t, hc, ts.URL)
+		assert.Equal(t, "v2", body)
+
+		msd.AssertCount(t, HttpClientCacheRevalidationKey, 1, "cache_result:not_modified")
+		msd.AssertCount(t, HttpClientCacheRevalidationKey, 1, "cache_result:modified")
+	})
+
+	t.Run("should forget stale responses that are replaced by one that can't be stored", func(t *testing.T) {
+		var version, conditional atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") != "" {
+				conditional.Add(1)
+			}
+			if version.Load() == 0 {
+				w.Header().Set("ETag", `"v1"`)
+				io.WriteString(w, "v1")
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			io.WriteString(w, "v2")
+		}))
+		defer ts.Close()
+		store := NewLRUCacheStore(1 << 20)
+		hc, msd, _ := newTestCacheClient(store)
+
+		getBody(t, hc, ts.URL)
+		version.Store(1)
+		_, body := getBody(t, hc, ts.URL)
+		assert.Equal(t, "v2", body)
+		_, ok := store.Get(ts.URL)
+		assert.False(t, ok)
+
+		getBody(t, hc, ts.URL)
+		assert.Equal(t, int32(1), conditional.Load(), "the old response shouldn't be revalidated again")
+		msd.AssertCount(t, HttpClientCacheRevalidationKey, 1, "cache_result:modified")
+		msd.AssertCount(t, HttpClientCacheMissKey, 2)
+	})
+
+	t.Run("should not cache responses with no-store or without an expiry or validator", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if r.URL.Path == "/no-store" {
+				w.Header().Set("Cache-Control", "no-store, max-age=60")
+			}
+			io.WriteString(w, "data")
+		}))
+		defer ts.Close()
+		hc, msd, _ := newTestCacheClient(NewLRUCacheStore(1 << 20))
+
+		for _, path := range []string{"/no-store", "/no-store", "/plain", "/plain"} {
+			getBody(t, hc, ts.URL+path)
+		}
+
+		assert.Equal(t, int32(4), requests.Load())
+		msd.AssertCount(t, HttpClientCacheMissKey, 4)
+		msd.AssertNotCalled(t, HttpClientCacheHitKey)
+	})
+
+	t.Run("should not share responses to requests with different credentials", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, "data for "+r.Header.Get("Authorization"))
+		}))
+		defer ts.Close()
+		hc, _, _ := newTestCacheClient(NewLRUCacheStore(1 << 20))
+
+		_, body := getBody(t, hc, ts.URL, "Authorization", "Bearer alice")
+		assert.Equal(t, "data for Bearer alice", body)
+		_, body = getBody(t, hc, ts.URL, "Authorization", "Bearer bob")
+		assert.Equal(t, "data for Bearer bob", body)
+		assert.Equal(t, int32(2), requests.Load())
+	})
+
+	t.Run("should cache responses to requests with credentials when the response is public", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			io.WriteString(w, "reference data")
+		}))
+		defer ts.Close()
+		hc, _, _ := newTestCacheClient(NewLRUCacheStore(1 << 20))
+
+		getBody(t, hc, ts.URL, "Authorization", "Bearer alice")
+		_, body := getBody(t, hc, ts.URL, "Authorization", "Bearer bob")
+
+		assert.Equal(t, "reference data", body)
+		assert.Equal(t, int32(1), requests.Load())
+	})
+
+	t.Run("should stream responses that are too big to store", func(t *testing.T) {
+		var requests atomic.Int32
+		finish := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, "more than ten bytes")
+			w.(http.Flusher).Flush()
+			<-finish
+			io.WriteString(w, " and the rest")
+		}))
+		defer ts.Close()
+		hc, _, _ := newTestCacheClient(NewLRUCacheStore(10))
+
+		responses := make(chan *http.Response)
+		go func() {
+			resp, err := hc.Get(ts.URL)
+			assert.NoError(t, err)
+			responses <- resp
+		}()
+		var resp *http.Response
+		select {
+		case resp = <-responses:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the response was read to the end before being returned")
+		}
+		close(finish)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, "more than ten bytes and the rest", string(body))
+		getBody(t, hc, ts.URL)
+		assert.Equal(t, int32(2), requests.Load())
+	})
+
+	t.Run("should revalidate when the request has no-cache", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			io.WriteString(w, "data")
+		}))
+		defer ts.Close()
+		hc, msd, _ := newTestCacheClient(NewLRUCacheStore(1 << 20))
+
+		getBody(t, hc, ts.URL)
+		_, body := getBody(t, hc, ts.URL, "Cache-Control", "no-cache")
+
+		assert.Equal(t, "data", body)
+		assert.Equal(t, int32(2), requests.Load())
+		msd.AssertCount(t, HttpClientCacheRevalidationKey, 1, "cache_result:not_modified")
+	})
+
+	t.Run("should serve stale responses while revalidating them in the background", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			io.WriteString(w, "data")
+		}))
+		defer ts.Close()
+		hc, msd, mc := newTestCacheClient(NewLRUCacheStore(1 << 20))
+
+		getBody(t, hc, ts.URL)
+		mc.Advance(70 * time.Second)
+		resp, body := getBody(t, hc, ts.URL)
+
+		assert.Equal(t, "data", body)
+		assert.Equal(t, "70", resp.Header.Get("Age"))
+		msd.AssertCount(t, HttpClientCacheHitKey, 1, "cache_status:stale")
+		msd.AssertEventually(t, HttpClientCacheRevalidationKey, time.Second, "cache_result:not_modified")
+		assert.Equal(t, int32(2), requests.Load())
+	})
+
+	t.Run("should only use responses for requests with the same headers named by Vary", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			io.WriteString(w, r.Header.Get("Accept-Language"))
+		}))
+		defer ts.Close()
+		hc, _, _ := newTestCacheClient(NewLRUCacheStore(1 << 20))
+
+		_, body := getBody(t, hc, ts.URL, "Accept-Language", "en")
+		assert.Equal(t, "en", body)
+		_, body = getBody(t, hc, ts.URL, "Accept-Language", "fr")
+		assert.Equal(t, "fr", body)
+		_, body = getBody(t, hc, ts.URL, "Accept-Language", "fr")
+		assert.Equal(t, "fr", body)
+
+		assert.Equal(t, int32(2), requests.Load())
+	})
+
+	t.Run("should invalidate a cached response after an unsafe request to it", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				requests.Add(1)
+			}
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, "data")
+		}))
+		defer ts.Close()
+		hc, _, _ := newTestCacheClient(NewLRUCacheStore(1 << 20))
+
+		getBody(t, hc, ts.URL)
+		resp, err := hc.Post(ts.URL, "text/plain", strings.NewReader("update"))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		getBody(t, hc, ts.URL)
+
+		assert.Equal(t, int32(2), requests.Load())
+	})
+}
+
+func TestCachedResponse_FreshnessLifetime(t *testing.T) {
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=300"}}, 5 * time.Minute},
+		{"max-age over Expires", http.Header{"Cache-Control": {"max-age=10"}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, 10 * time.Second},
+		{"Expires", http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"invalid Expires", http.Header{"Expires": {"0"}}, 0},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=300"}}, 0},
+		{"nothing", http.Header{}, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cr := &CachedResponse{Header: test.header, ResponseTime: date}
+			assert.Equal(t, test.expected, cr.freshnessLifetime(parseCacheControl(test.header)))
+		})
+	}
+}
+
+func TestLRUCacheStore(t *testing.T) {
+
+	response := func(body string) *CachedResponse {
+		return &CachedResponse{StatusCode: http.StatusOK, Body: []byte(body)}
+	}
+
+	t.Run("should get, set and delete responses", func(t *testing.T) {
+		store := NewLRUCacheStore(100)
+		store.Set("a", response("one"))
+
+		cached, ok := store.Get("a")
+		assert.True(t, ok)
+		assert.Equal(t, []byte("one"), cached.Body)
+
+		store.Delete("a")
+		_, ok = store.Get("a")
+		assert.False(t, ok)
+	})
+
+	t.Run("should evict the least recently used responses", func(t *testing.T) {
+		store := NewLRUCacheStore(30)
+		store.Set("a", response("123456789"))
+		store.Set("b", response("123456789"))
+		store.Set("c", response("123456789"))
+		store.Get("a")
+		store.Set("d", response("123456789"))
+
+		_, ok := store.Get("b")
+		assert.False(t, ok)
+		for _, key := range []string{"a", "c", "d"} {
+			_, ok := store.Get(key)
+			assert.True(t, ok, key)
+		}
+	})
+
+	t.Run("should not store responses bigger than the store", func(t *testing.T) {
+		store := NewLRUCacheStore(10)
+		store.Set("a", response("1234"))
+		store.Set("b", response("123456789012"))
+
+		_, ok := store.Get("b")
+		assert.False(t, ok)
+		_, ok = store.Get("a")
+		assert.True(t, ok)
+	})
+
+	t.Run("should count the size of replaced responses once", func(t *testing.T) {
+		store := NewLRUCacheStore(20)
+		for i := 0; i < 10; i++ {
+			store.Set("a", response("123456789"))
+		}
+		store.Set("b", response("123456789"))
+
+		_, ok := store.Get("a")
+		assert.True(t, ok)
+	})
+}
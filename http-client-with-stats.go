@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"time"
 )
 
@@ -16,33 +17,154 @@ type HTTPClientWithStats interface {
 
 type clock interface {
 	Now() time.Time
+	// After sends the time on the returned channel once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// HTTPClientOption configures optional behaviour of an HTTPClientWithStats
+type HTTPClientOption func(*httpClientWithStats)
+
+// WithAdaptiveLimiter bounds the number of concurrent requests made by the client. Requests over the
+// current limit fail straight away with ErrLimitExceeded. Transport errors, 5xx and 429 responses count
+// as failures and reduce the limit.
+func WithAdaptiveLimiter(limiter AdaptiveLimiter) HTTPClientOption {
+	return func(thc *httpClientWithStats) {
+		thc.limiter = limiter
+	}
+}
+
+// WithRateLimiter limits the rate of requests made by the client to each host, or each key picked by
+// WithRateLimitKey. Requests over the limit fail straight away with ErrRateLimited.
+func WithRateLimiter(limiter RateLimiter) HTTPClientOption {
+	return func(thc *httpClientWithStats) {
+		thc.rateLimiter = limiter
+	}
+}
+
+// WithRateLimitKey changes the key requests are rate limited by, e.g. to RateLimitByCallee. The tags passed
+// to Do are added to the tags carried by the request context before keyFunc is called.
+func WithRateLimitKey(keyFunc RateLimitKeyFunc) HTTPClientOption {
+	return func(thc *httpClientWithStats) {
+		thc.rateLimitKey = keyFunc
+	}
+}
+
+// WithClientMetricNames changes the names of the metrics recorded for each request. Leave a name empty to
+// not record that metric.
+func WithClientMetricNames(names HTTPMetricNames) HTTPClientOption {
+	return func(thc *httpClientWithStats) {
+		thc.names = names
+	}
+}
+
+// WithClientTags adds tags to every metric recorded by the client
+func WithClientTags(tags ...string) HTTPClientOption {
+	return func(thc *httpClientWithStats) {
+		thc.tags = append(thc.tags, tags...)
+	}
 }
 
 type httpClientWithStats struct {
-	httpClient *http.Client
-	statsd     StatsD
-	clock      clock
+	httpClient   *http.Client
+	statsd       StatsD
+	clock        clock
+	limiter      AdaptiveLimiter
+	rateLimiter  RateLimiter
+	rateLimitKey RateLimitKeyFunc
+	hedger       *hedger
+	cache        *httpCache
+	dump         *HTTPDump
+	names        HTTPMetricNames
+	tags         []string
 }
 
+// Do sends r and records metrics about it, with tags, the method, the host, the route template and any tags
+// carried by the request context
 func (thc *httpClientWithStats) Do(r *http.Request, tags ...string) (*http.Response, error) {
-	tags = append(tags, fmt.Sprintf("method:%s", r.Method))
-	start := thc.clock.Now()
-	resp, err := thc.httpClient.Do(r)
+	statsd := thc.statsd.WithContext(r.Context())
+	tags = append(append(append([]string{}, thc.tags...), tags...), fmt.Sprintf("method:%s", r.Method))
+	if host := requestHost(r); host != "" {
+		tags = append(tags, "http_host:"+host)
+	}
+	if template := RouteTemplateFromContext(r.Context()); template != "" {
+		tags = append(tags, "http_route:"+template)
+	}
+	tags = slices.Clip(tags)
+	if thc.cache != nil {
+		return thc.cache.do(r, statsd, tags, func(r *http.Request) (*http.Response, error) {
+			return thc.send(r, statsd, tags)
+		})
+	}
+	return thc.send(r, statsd, tags)
+}
+
+// send sends r, recording its metrics with tags
+func (thc *httpClientWithStats) send(r *http.Request, statsd StatsD, tags []string) (resp *http.Response, err error) {
+	if thc.rateLimiter != nil && r.URL != nil && !thc.allowRate(r, tags) {
+		statsd.Incr(HttpClientRateLimitedKey, tags...)
+		return nil, ErrRateLimited
+	}
+	if thc.limiter != nil {
+		release, ok := thc.limiter.Acquire()
+		if !ok {
+			statsd.Incr(HttpClientLimitedKey, tags...)
+			return nil, ErrLimitExceeded
+		}
+		defer func() { release(limiterSuccess(resp, err)) }()
+	}
+	dumping := thc.dump != nil && thc.dump.Enabled()
+	if dumping {
+		r = thc.dump.dumpRequest(r)
+	}
+	timer := startTimer(statsd, thc.clock, thc.names.ResponseTime, tags...)
+	if thc.hedger != nil {
+		resp, err = thc.hedger.do(thc, r, statsd, tags)
+	} else {
+		resp, err = thc.httpClient.Do(r)
+	}
 	if err != nil {
-		thc.statsd.Incr(HttpClientResponseErrorKey, tags...)
+		errorTypeTag := "error_type:" + errorType(err)
+		if thc.names.ResponseTime != "" {
+			timer.StopWithTags(errorTypeTag)
+		}
+		thc.names.incr(statsd, thc.names.ResponseError, append(tags, errorTypeTag)...)
 	} else {
-		finish := thc.clock.Now()
-		duration := (finish.Nanosecond() - start.Nanosecond()) / 1000000
-		tags = append(tags, fmt.Sprintf("resp_status:%d", resp.StatusCode))
-		thc.statsd.Histogram(HttpClientResponseTimeKey, float64(duration), tags...)
-		thc.statsd.Incr(HttpClientResponseSuccessKey, tags...)
-		responseCodeKey := fmt.Sprintf(HttpClientResponseCodeFormatKey, resp.StatusCode)
-		thc.statsd.Incr(responseCodeKey, tags...)
-		thc.statsd.Incr(HttpClientResponseCodeAllKey, tags...)
+		respStatusTag := fmt.Sprintf("resp_status:%d", resp.StatusCode)
+		if thc.names.ResponseTime != "" {
+			timer.StopWithTags(respStatusTag)
+		}
+		tags = append(tags, respStatusTag)
+		thc.names.incr(statsd, thc.names.ResponseSuccess, tags...)
+		thc.names.incrResponseCodes(statsd, resp.StatusCode, tags...)
+	}
+	if dumping {
+		thc.dump.dumpResponse(r, resp, err)
 	}
 	return resp, err
 }
 
+// acquireHedge takes a rate limit token and an adaptive limiter slot for a hedge of r, like send does for r
+// itself. It returns false if either isn't available. Otherwise release must be called once the hedge completes.
+func (thc *httpClientWithStats) acquireHedge(r *http.Request, tags []string) (release func(success bool), ok bool) {
+	if thc.rateLimiter != nil && r.URL != nil && !thc.allowRate(r, tags) {
+		return nil, false
+	}
+	if thc.limiter == nil {
+		return func(bool) {}, true
+	}
+	return thc.limiter.Acquire()
+}
+
+// limiterSuccess reports whether the outcome of a request should grow the adaptive limit rather than shrink it
+func limiterSuccess(resp *http.Response, err error) bool {
+	return err == nil && resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests
+}
+
+// allowRate takes a token for r from the rate limiter, if one is available
+func (thc *httpClientWithStats) allowRate(r *http.Request, tags []string) bool {
+	return thc.rateLimiter.Allow(thc.rateLimitKey(r.WithContext(ContextWithTags(r.Context(), tags...)))).Allowed
+}
+
 func (thc *httpClientWithStats) Get(url string, tags ...string) (resp *http.Response, err error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -60,12 +182,28 @@ func (thc *httpClientWithStats) Post(url string, bodyType string, body io.Reader
 	return thc.Do(req, tags...)
 }
 
+func requestHost(r *http.Request) string {
+	if r.URL != nil && r.URL.Host != "" {
+		return r.URL.Host
+	}
+	return r.Host
+}
+
 type timeClock struct{}
 
 func (c *timeClock) Now() time.Time {
 	return time.Now()
 }
 
-func NewHTTPClientWithStats(client *http.Client, statsd StatsD) HTTPClientWithStats {
-	return &httpClientWithStats{statsd: statsd, httpClient: client, clock: &timeClock{}}
+func (c *timeClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func NewHTTPClientWithStats(client *http.Client, statsd StatsD, opts ...HTTPClientOption) HTTPClientWithStats {
+	thc := &httpClientWithStats{statsd: statsd, httpClient: client, clock: &timeClock{},
+		rateLimitKey: RateLimitByHost, names: DefaultHTTPClientMetricNames()}
+	for _, opt := range opts {
+		opt(thc)
+	}
+	return thc
 }
@@ -1,30 +1,79 @@
 package tools
 
 import (
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// fakeClock is a clock for tests. Every call to Now moves it on by step, and Advance moves it on by any duration.
 type fakeClock struct {
+	mu          sync.Mutex
 	currentTime time.Time
+	step        time.Duration
+	timers      []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(step time.Duration) *fakeClock {
+	return &fakeClock{currentTime: time.Now(), step: step}
 }
 
 func (f *fakeClock) Now() time.Time {
-	f.currentTime = f.currentTime.Add(100 * time.Millisecond)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.currentTime = f.currentTime.Add(f.step)
+	f.fire()
 	return f.currentTime
 }
 
+// After returns a channel that is sent the time once the clock has been advanced by d
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timers = append(f.timers, fakeTimer{at: f.currentTime.Add(d), c: make(chan time.Time, 1)})
+	c := f.timers[len(f.timers)-1].c
+	f.fire()
+	return c
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.currentTime = f.currentTime.Add(d)
+	f.fire()
+}
+
+// fire sends the time to the timers that are due. It must be called with the lock held.
+func (f *fakeClock) fire() {
+	pending := f.timers[:0]
+	for _, timer := range f.timers {
+		if timer.at.After(f.currentTime) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- f.currentTime
+	}
+	f.timers = pending
+}
+
 func TestHTTPClientWithStats_Do(t *testing.T) {
 
-	fc := &fakeClock{time.Now()}
+	fc := newFakeClock(100 * time.Millisecond)
 	msd := &MockStatsD{}
 	hc := http.DefaultClient
-	wc := &httpClientWithStats{statsd: msd, httpClient: hc, clock: fc}
+	wc := &httpClientWithStats{statsd: msd, httpClient: hc, clock: fc, names: DefaultHTTPClientMetricNames()}
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
 		fmt.Fprintln(w, "Hello World")
@@ -37,7 +86,7 @@ func TestHTTPClientWithStats_Do(t *testing.T) {
 
 	resp, _ := wc.Do(req, "http_callee:my-remote-service", "operation:my-operation")
 
-	expectedTags := []string{"http_callee:my-remote-service", "operation:my-operation", "method:GET", "resp_status:200"}
+	expectedTags := []string{"http_callee:my-remote-service", "operation:my-operation", "method:GET", "http_host:" + ts.Listener.Addr().String(), "resp_status:200"}
 
 	assert.Len(t, msd.Calls, 4)
 	assert.NotNil(t, resp)
@@ -66,12 +115,59 @@ func TestHTTPClientWithStats_Do_Error(t *testing.T) {
 
 	resp, err := wc.Do(req, "http_callee:my-remote-service", "operation:my-operation")
 
-	assert.Len(t, msd.Calls, 1)
+	expectedTags := []string{"http_callee:my-remote-service", "operation:my-operation", "method:GET", "http_host:nil", "error_type:other"}
+	assert.Len(t, msd.Calls, 2)
 	assert.NotNil(t, err)
 	assert.Nil(t, resp)
-	assert.Equal(t, "Incr", msd.Calls[0].Method)
-	assert.Equal(t, "http_client.response_error", msd.Calls[0].Args.Name)
-	assert.Equal(t, []string{"http_callee:my-remote-service", "operation:my-operation", "method:GET"}, msd.Calls[0].Args.Tags)
+	assert.Equal(t, "Histogram", msd.Calls[0].Method)
+	assert.Equal(t, "http_client.response_time_ms", msd.Calls[0].Args.Name)
+	assert.Equal(t, expectedTags, msd.Calls[0].Args.Tags)
+	assert.Equal(t, "Incr", msd.Calls[1].Method)
+	assert.Equal(t, "http_client.response_error", msd.Calls[1].Args.Name)
+	assert.Equal(t, expectedTags, msd.Calls[1].Args.Tags)
+}
+
+func TestHTTPClientWithStats_Do_ErrorTypes(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer tlsServer.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	closedURL := closed.URL
+	closed.Close()
+	noSuchHost := &http.Client{Transport: &http.Transport{
+		DialContext: func(_ context.Context, _, address string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: address, IsNotFound: true}}
+		},
+	}}
+
+	tests := []struct {
+		name      string
+		client    *http.Client
+		url       string
+		errorType string
+	}{
+		{"timeout", &http.Client{Timeout: 10 * time.Millisecond}, slow.URL, "timeout"},
+		{"connection refused", http.DefaultClient, closedURL, "connection_refused"},
+		{"dns", noSuchHost, "http://does-not-exist.invalid", "dns"},
+		{"tls", http.DefaultClient, tlsServer.URL, "tls"},
+	}
+	for _, tt := range tests {
+		t.Run("should tag "+tt.name+" errors", func(t *testing.T) {
+			msd := &MockStatsD{}
+			wc := NewHTTPClientWithStats(tt.client, msd)
+
+			_, err := wc.Get(tt.url)
+
+			assert.Error(t, err)
+			msd.AssertCalled(t, HttpClientResponseTimeKey, "error_type:"+tt.errorType)
+			msd.AssertCalled(t, HttpClientResponseErrorKey, "error_type:"+tt.errorType)
+		})
+	}
 }
 
 func TestHTTPClientWithStats_Get(t *testing.T) {
@@ -91,7 +187,7 @@ func TestHTTPClientWithStats_Get(t *testing.T) {
 	assert.Len(t, msd.Calls, 4)
 	assert.NotNil(t, resp)
 	assert.Equal(t, "Histogram", msd.Calls[0].Method)
-	assert.Equal(t, []string{"http_callee:my-remote-service", "operation:my-operation", "method:GET", "resp_status:200"}, msd.Calls[0].Args.Tags)
+	assert.Equal(t, []string{"http_callee:my-remote-service", "operation:my-operation", "method:GET", "http_host:" + ts.Listener.Addr().String(), "resp_status:200"}, msd.Calls[0].Args.Tags)
 	assert.Equal(t, "Incr", msd.Calls[2].Method)
 	assert.Equal(t, "http_client.response_code.200", msd.Calls[2].Args.Name)
 	assert.Equal(t, "Incr", msd.Calls[3].Method)
@@ -114,9 +210,84 @@ func TestHttpClientWithStats_Post(t *testing.T) {
 	assert.Len(t, msd.Calls, 4)
 	assert.NotNil(t, resp)
 	assert.Equal(t, "Histogram", msd.Calls[0].Method)
-	assert.Equal(t, []string{"http_callee:my-remote-service", "operation:my-operation", "method:POST", "resp_status:200"}, msd.Calls[0].Args.Tags)
+	assert.Equal(t, []string{"http_callee:my-remote-service", "operation:my-operation", "method:POST", "http_host:" + ts.Listener.Addr().String(), "resp_status:200"}, msd.Calls[0].Args.Tags)
 	assert.Equal(t, "Incr", msd.Calls[2].Method)
 	assert.Equal(t, "http_client.response_code.200", msd.Calls[2].Args.Name)
 	assert.Equal(t, "Incr", msd.Calls[3].Method)
 	assert.Equal(t, "http_client.response_code.all", msd.Calls[3].Args.Name)
 }
+
+func TestHTTPClientWithStats_MetricOptions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	t.Run("should use the configured names and tags", func(t *testing.T) {
+		msd := &MockStatsD{}
+		names := DefaultHTTPClientMetricNames()
+		names.ResponseTime = "search_client.time_ms"
+		names.ResponseCode = ""
+		names.ResponseSuccess = ""
+		wc := NewHTTPClientWithStats(http.DefaultClient, msd, WithClientMetricNames(names), WithClientTags("client:search"))
+
+		resp, err := wc.Get(ts.URL, "operation:query")
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		expectedTags := []string{"client:search", "operation:query", "method:GET", "http_host:" + ts.Listener.Addr().String(), "resp_status:202"}
+		assert.Len(t, msd.Calls, 2)
+		assert.Equal(t, Call{"Histogram", Args{"search_client.time_ms", msd.Calls[0].Args.Value, expectedTags}}, msd.Calls[0])
+		assert.Equal(t, Call{"Incr", Args{HttpClientResponseCodeAllKey, 0, expectedTags}}, msd.Calls[1])
+	})
+
+	t.Run("should not record metrics without a name", func(t *testing.T) {
+		msd := &MockStatsD{}
+		wc := NewHTTPClientWithStats(http.DefaultClient, msd, WithClientMetricNames(HTTPMetricNames{}))
+
+		resp, err := wc.Get(ts.URL)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		_, err = wc.Get("http://localhost:0")
+		assert.Error(t, err)
+
+		assert.Empty(t, msd.Calls)
+	})
+}
+
+func TestHTTPClientWithStats_RouteTemplate(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	t.Run("should tag requests with the route template of GetTemplate", func(t *testing.T) {
+		msd := &MockStatsD{}
+		wc := NewHTTPClientWithStats(http.DefaultClient, msd)
+
+		ctx := ContextWithTags(context.Background(), "tenant:a")
+
+		resp, err := GetTemplate(ctx, wc, ts.URL+"/users/{id}/orders/{order}?expand=true", []string{"a b", "7"}, "http_callee:users")
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, "/users/a%20b/orders/7", paths[len(paths)-1])
+		msd.AssertCount(t, HttpClientResponseCodeAllKey, 1, "tenant:a", "http_callee:users", "http_route:/users/{id}/orders/{order}", "http_host:"+ts.Listener.Addr().String())
+	})
+
+	t.Run("should tag requests with the route template in the context", func(t *testing.T) {
+		msd := &MockStatsD{}
+		wc := NewHTTPClientWithStats(http.DefaultClient, msd)
+		ctx := ContextWithRouteTemplate(context.Background(), "/users/{id}")
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/users/123", nil)
+
+		resp, err := wc.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		msd.AssertCount(t, HttpClientResponseCodeAllKey, 1, "http_route:/users/{id}")
+		assert.False(t, msd.HasTag(HttpClientResponseCodeAllKey, "http_route:/users/123"))
+	})
+}
@@ -0,0 +1,330 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultDumpMaxBodySize = 4096
+	redactedValue          = "[REDACTED]"
+)
+
+// defaultDumpDenyHeaders are always redacted, as they hold credentials
+var defaultDumpDenyHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// HTTPDumpConfig configures what an HTTPDump logs
+type HTTPDumpConfig struct {
+	// Enabled is whether requests are logged from the start
+	Enabled bool
+	// AllowHeaders, when set, are the only headers logged with their values. Other headers are redacted.
+	AllowHeaders []string
+	// DenyHeaders are redacted, as well as Authorization, Proxy-Authorization, Cookie and Set-Cookie. Query
+	// parameters with the same names are redacted too.
+	DenyHeaders []string
+	// RedactFields are the names of fields in JSON bodies to redact, at any depth, and of fields in form bodies
+	// and query parameters
+	RedactFields []string
+	// MaxBodySize is the number of bytes of each body to log. It is 4KB by default, and bodies aren't logged
+	// when it's negative.
+	MaxBodySize int
+}
+
+// HTTPDump logs the requests made by an HTTP client and their responses, with their headers and bodies, at
+// debug level. It can be turned on and off while the client is in use, to debug an integration without
+// redeploying.
+type HTTPDump struct {
+	log          Logger
+	maxBodySize  int
+	allowHeaders map[string]bool
+	denyHeaders  map[string]bool
+	denyParams   map[string]bool
+	redactFields map[string]bool
+	enabled      atomic.Bool
+}
+
+// NewHTTPDump creates an HTTPDump that logs to log. Pass it to NewHTTPClientWithStats with WithDump.
+func NewHTTPDump(log Logger, config HTTPDumpConfig) *HTTPDump {
+	d := &HTTPDump{
+		log:          log,
+		maxBodySize:  config.MaxBodySize,
+		allowHeaders: make(map[string]bool),
+		denyHeaders:  make(map[string]bool),
+		denyParams:   make(map[string]bool),
+		redactFields: make(map[string]bool),
+	}
+	if d.maxBodySize == 0 {
+		d.maxBodySize = defaultDumpMaxBodySize
+	}
+	for _, name := range config.AllowHeaders {
+		d.allowHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range append(defaultDumpDenyHeaders, config.DenyHeaders...) {
+		d.denyHeaders[http.CanonicalHeaderKey(name)] = true
+		d.denyParams[strings.ToLower(name)] = true
+	}
+	for _, field := range config.RedactFields {
+		d.redactFields[strings.ToLower(field)] = true
+		d.denyParams[strings.ToLower(field)] = true
+	}
+	d.enabled.Store(config.Enabled)
+	return d
+}
+
+// Enable starts logging requests
+func (d *HTTPDump) Enable() {
+	d.enabled.Store(true)
+}
+
+// Disable stops logging requests
+func (d *HTTPDump) Disable() {
+	d.enabled.Store(false)
+}
+
+// Enabled reports whether requests are being logged
+func (d *HTTPDump) Enabled() bool {
+	return d.enabled.Load()
+}
+
+// WithDump logs the requests made by the client and their responses with dump while it is enabled
+func WithDump(dump *HTTPDump) HTTPClientOption {
+	return func(thc *httpClientWithStats) {
+		thc.dump = dump
+	}
+}
+
+// dumpRequest logs r and returns a copy of it to send, with the body that was read to log put back
+func (d *HTTPDump) dumpRequest(r *http.Request) *http.Request {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP request: %s %s", r.Method, d.redactURL(r.URL))
+	d.writeHeader(&b, r.Header)
+	if r.Body != nil && r.Body != http.NoBody && d.maxBodySize > 0 {
+		prefix, body := peekBody(r.Body, d.maxBodySize)
+		r = r.WithContext(r.Context())
+		r.Body = body
+		d.writeBody(&b, r.Header, prefix, true)
+	}
+	d.log.Debug(b.String())
+	return r
+}
+
+// dumpResponse logs the response to r, or the error sending it. The body is logged as the caller reads it, once
+// it has been read to the end or closed, so that streaming responses aren't held up.
+func (d *HTTPDump) dumpResponse(r *http.Request, resp *http.Response, err error) {
+	if err != nil {
+		d.log.Debugf("HTTP request failed: %s %s: %v", r.Method, d.redactURL(r.URL), redactURLError(err))
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP response: %s %s: %s", r.Method, d.redactURL(r.URL), resp.Status)
+	d.writeHeader(&b, resp.Header)
+	if resp.Body == nil || resp.Body == http.NoBody || d.maxBodySize <= 0 {
+		d.log.Debug(b.String())
+		return
+	}
+	header := resp.Header
+	resp.Body = &dumpBody{ReadCloser: resp.Body, limit: d.maxBodySize + 1, done: func(prefix []byte, complete bool) {
+		d.writeBody(&b, header, prefix, complete)
+		d.log.Debug(b.String())
+	}}
+}
+
+// redactURL returns u with its password and denied query parameters redacted
+func (d *HTTPDump) redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = redactQuery(u.RawQuery, d.denyParams)
+	return redacted.Redacted()
+}
+
+// redactQuery replaces the values of the parameters in query named by names, matched case-insensitively. The
+// order and encoding of the other parameters are kept.
+func redactQuery(query string, names map[string]bool) string {
+	if query == "" {
+		return query
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		rawName, _, _ := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		if names[strings.ToLower(name)] {
+			params[i] = rawName + "=" + redactedValue
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// redactURLError removes the URL from err, as it has already been logged with redactions
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+func (d *HTTPDump) writeHeader(b *strings.Builder, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if d.denyHeaders[name] || (len(d.allowHeaders) > 0 && !d.allowHeaders[name]) {
+			value = redactedValue
+		}
+		fmt.Fprintf(b, "\n%s: %s", name, value)
+	}
+}
+
+// writeBody writes prefix, which is truncated if it's longer than the maximum body size. complete is false
+// when the body wasn't read to the end, so prefix may be cut short. JSON and form bodies have their fields
+// redacted, and aren't written at all if that isn't possible.
+func (d *HTTPDump) writeBody(b *strings.Builder, header http.Header, prefix []byte, complete bool) {
+	if len(prefix) == 0 && complete {
+		return
+	}
+	truncated := len(prefix) > d.maxBodySize
+	if len(d.redactFields) > 0 && (isJSONContent(header) || isFormContent(header)) {
+		kind := "JSON"
+		if isFormContent(header) {
+			kind = "form"
+		}
+		if truncated {
+			fmt.Fprintf(b, "\n\n[%s body over %d bytes not logged as it can't be redacted]", kind, d.maxBodySize)
+			return
+		}
+		if !complete {
+			fmt.Fprintf(b, "\n\n[%s body not logged as it wasn't read to the end]", kind)
+			return
+		}
+		if kind == "form" {
+			prefix = []byte(redactQuery(string(prefix), d.redactFields))
+		} else {
+			redacted, err := redactJSON(prefix, d.redactFields)
+			if err != nil {
+				b.WriteString("\n\n[invalid JSON body not logged as it can't be redacted]")
+				return
+			}
+			prefix = redacted
+		}
+		truncated = len(prefix) > d.maxBodySize
+	}
+	b.WriteString("\n\n")
+	if truncated {
+		fmt.Fprintf(b, "%s... [truncated to %d bytes]", prefix[:d.maxBodySize], d.maxBodySize)
+		return
+	}
+	b.Write(prefix)
+	if !complete {
+		b.WriteString("... [not read to the end]")
+	}
+}
+
+// dumpBody keeps the first limit bytes of a response body as the caller reads it, and passes them to done
+// once the body has been read to the end or closed
+type dumpBody struct {
+	io.ReadCloser
+	limit    int
+	prefix   []byte
+	complete bool
+	once     sync.Once
+	done     func(prefix []byte, complete bool)
+}
+
+func (b *dumpBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if keep := min(n, b.limit-len(b.prefix)); keep > 0 {
+		b.prefix = append(b.prefix, p[:keep]...)
+	}
+	if err != nil {
+		b.complete = err == io.EOF
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *dumpBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+func (b *dumpBody) finish() {
+	b.once.Do(func() { b.done(b.prefix, b.complete) })
+}
+
+// peekBody reads up to n+1 bytes of body, so it is known whether there was more than n, and returns them with
+// a body that reads them again followed by the rest
+func peekBody(body io.ReadCloser, n int) ([]byte, io.ReadCloser) {
+	prefix, err := io.ReadAll(io.LimitReader(body, int64(n)+1))
+	rest := io.Reader(body)
+	if err != nil {
+		rest = &errorReader{err}
+	}
+	return prefix, &readCloser{io.MultiReader(bytes.NewReader(prefix), rest), body}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func isJSONContent(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+func isFormContent(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// redactJSON replaces the values of fields in body, matched case-insensitively, at any depth
+func redactJSON(body []byte, fields map[string]bool) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(redactValue(value, fields))
+}
+
+func redactValue(value interface{}, fields map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if fields[strings.ToLower(key)] {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactValue(field, fields)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item, fields)
+		}
+	}
+	return value
+}
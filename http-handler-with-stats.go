@@ -6,24 +6,59 @@ import (
 	"net/http"
 )
 
-// HTTPHandlerWithStats takes an http.Handler and adds the sending of response time metrics to DataDog, and debug logging of request details
-func HTTPHandlerWithStats(routeName string, router http.Handler, logger Logger, statsd StatsD) http.Handler {
+// HTTPHandlerOption configures optional behaviour of HTTPHandlerWithStats
+type HTTPHandlerOption func(*httpHandlerConfig)
+
+type httpHandlerConfig struct {
+	names HTTPMetricNames
+	tags  []string
+}
+
+// WithHandlerMetricNames changes the names of the metrics recorded for each request. Leave a name empty to not
+// record that metric.
+func WithHandlerMetricNames(names HTTPMetricNames) HTTPHandlerOption {
+	return func(c *httpHandlerConfig) {
+		c.names = names
+	}
+}
+
+// WithHandlerTags adds tags to every metric recorded by the handler
+func WithHandlerTags(tags ...string) HTTPHandlerOption {
+	return func(c *httpHandlerConfig) {
+		c.tags = append(c.tags, tags...)
+	}
+}
+
+// HTTPHandlerWithStats takes an http.Handler and adds the sending of response time metrics to DataDog, and debug logging of request details.
+// The route is added to the tags in the request context, so metrics recorded while handling the request, e.g. by
+// an HTTPClientWithStats, are tagged with it too.
+func HTTPHandlerWithStats(routeName string, router http.Handler, logger Logger, statsd StatsD, opts ...HTTPHandlerOption) http.Handler {
+	config := httpHandlerConfig{names: DefaultHTTPHandlerMetricNames()}
+	for _, opt := range opts {
+		opt(&config)
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		logger.Debug(r.Method, "at", r.URL.String())
-		metrics := httpsnoop.CaptureMetrics(router, w, r)
+		ctx := r.Context()
+		metrics := httpsnoop.CaptureMetrics(router, w, r.WithContext(ContextWithTags(ctx, "route:"+routeName)))
 
-		logResult(routeName, metrics, statsd, logger, r)
+		logResult(routeName, metrics, statsd.WithContext(ctx), logger, r, config)
 	})
 }
 
-func logResult(routeName string, metrics httpsnoop.Metrics, statsd StatsD, logger Logger, req *http.Request) {
+func logResult(routeName string, metrics httpsnoop.Metrics, statsd StatsD, logger Logger, req *http.Request, config httpHandlerConfig) {
 	responseTag := fmt.Sprintf("response:%d", metrics.Code)
-	tags := []string{"route:" + routeName, responseTag}
+	tags := withCallerTag(append([]string{"route:" + routeName, responseTag}, config.tags...), req)
+	if config.names.ResponseTime != "" {
+		statsd.Histogram(config.names.ResponseTime, durationInMs(metrics.Duration), tags...)
+	}
+	config.names.incrResponseCodes(statsd, metrics.Code, tags...)
+	logger.Debugf("Request to %s had response code %d in %dms", req.URL.String(), metrics.Code, metrics.Duration.Milliseconds())
+}
+
+func withCallerTag(tags []string, req *http.Request) []string {
 	if caller := req.Header.Get("X-Component"); caller != "" {
 		tags = append(tags, "caller:"+caller)
 	}
-	statsd.Histogram(WebResponseTimeKey, float64(metrics.Duration.Nanoseconds())/1000000, tags...)
-	statsd.Incr(fmt.Sprintf(WebResponseCodeFormatKey, metrics.Code), tags...)
-	statsd.Incr(WebResponseCodeAllKey, tags...)
-	logger.Debugf("Request to %s had response code %d in %dms", req.URL.String(), metrics.Code, metrics.Duration.Milliseconds())
+	return tags
 }
@@ -67,3 +67,57 @@ func TestHTTPHandlerWithStats_Error(t *testing.T) {
 
 	checkMetricsCalled(t, statsd, "route", http.StatusInternalServerError, "500")
 }
+
+func TestHTTPHandlerWithStats_TagsClientMetricsWithRoute(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	statsd := &MockStatsD{}
+	client := NewHTTPClientWithStats(http.DefaultClient, statsd)
+	httpHandler := HTTPHandlerWithStats("/Search/{index}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, backend.URL, nil)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		w.WriteHeader(http.StatusOK)
+	}), &MockLogger{}, statsd)
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	httpHandler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ContextWithTags(req.Context(), "tenant:a")))
+
+	statsd.AssertCalled(t, HttpClientResponseCodeAllKey, "tenant:a", "route:/Search/{index}", "method:GET")
+	statsd.AssertCalled(t, WebResponseCodeAllKey, "tenant:a", "route:/Search/{index}")
+	statsd.AssertCount(t, WebResponseCodeAllKey, 1)
+}
+
+func TestHTTPHandlerWithStats_NestedHandlers(t *testing.T) {
+	statsd := &MockStatsD{}
+	serveMux := http.NewServeMux()
+	serveMux.Handle("/hello", HTTPHandlerWithStats("/hello", &MockHandler{response: http.StatusOK}, &MockLogger{}, statsd))
+	httpHandler := HTTPHandlerWithStats("/", serveMux, &MockLogger{}, statsd)
+
+	httpHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/hello", nil))
+
+	assert.Len(t, statsd.Calls, 6)
+	assert.Equal(t, []string{"route:/hello", "response:200"}, statsd.Calls[0].Args.Tags, "the inner handler's route should win")
+	assert.Equal(t, []string{"route:/", "response:200"}, statsd.Calls[3].Args.Tags)
+}
+
+func TestHTTPHandlerWithStats_MetricOptions(t *testing.T) {
+	statsd := &MockStatsD{}
+	names := DefaultHTTPHandlerMetricNames()
+	names.ResponseCode = ""
+	names.ResponseTime = "search.response_time"
+	httpHandler := HTTPHandlerWithStats("route", &MockHandler{response: http.StatusNotFound}, &MockLogger{}, statsd,
+		WithHandlerMetricNames(names), WithHandlerTags("team:data"))
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("X-Component", "web")
+	httpHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	expectedTags := []string{"route:route", "response:404", "team:data", "caller:web"}
+	assert.Len(t, statsd.Calls, 2)
+	assert.Equal(t, Call{"Histogram", Args{"search.response_time", statsd.Calls[0].Args.Value, expectedTags}}, statsd.Calls[0])
+	assert.Equal(t, Call{"Incr", Args{WebResponseCodeAllKey, 0, expectedTags}}, statsd.Calls[1])
+}
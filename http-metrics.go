@@ -0,0 +1,57 @@
+package tools
+
+import "fmt"
+
+// HTTPMetricNames are the names of the metrics recorded by HTTPClientWithStats and HTTPHandlerWithStats. A
+// metric with an empty name isn't recorded. Leave ResponseCode empty to record a single ResponseCodeAll metric,
+// tagged with the status code, instead of a metric for each status code.
+type HTTPMetricNames struct {
+	// ResponseTime is a histogram of response times in milliseconds
+	ResponseTime string
+	// ResponseCode is a format for a counter for each status code, with a %d for the code
+	ResponseCode string
+	// ResponseCodeAll is a counter of every response
+	ResponseCodeAll string
+	// ResponseSuccess is a counter of requests that got a response. It is only recorded by HTTPClientWithStats.
+	ResponseSuccess string
+	// ResponseError is a counter of requests that failed without a response. It is only recorded by
+	// HTTPClientWithStats.
+	ResponseError string
+}
+
+// DefaultHTTPClientMetricNames returns the names of the metrics recorded by HTTPClientWithStats by default,
+// to change with WithClientMetricNames
+func DefaultHTTPClientMetricNames() HTTPMetricNames {
+	return HTTPMetricNames{
+		ResponseTime:    HttpClientResponseTimeKey,
+		ResponseCode:    HttpClientResponseCodeFormatKey,
+		ResponseCodeAll: HttpClientResponseCodeAllKey,
+		ResponseSuccess: HttpClientResponseSuccessKey,
+		ResponseError:   HttpClientResponseErrorKey,
+	}
+}
+
+// DefaultHTTPHandlerMetricNames returns the names of the metrics recorded by HTTPHandlerWithStats by default,
+// to change with WithHandlerMetricNames
+func DefaultHTTPHandlerMetricNames() HTTPMetricNames {
+	return HTTPMetricNames{
+		ResponseTime:    WebResponseTimeKey,
+		ResponseCode:    WebResponseCodeFormatKey,
+		ResponseCodeAll: WebResponseCodeAllKey,
+	}
+}
+
+// incr increments the counter name, unless it is empty because it has been turned off
+func (names HTTPMetricNames) incr(statsd StatsD, name string, tags ...string) {
+	if name != "" {
+		statsd.Incr(name, tags...)
+	}
+}
+
+// incrResponseCodes increments the ResponseCode metric for code and the ResponseCodeAll metric
+func (names HTTPMetricNames) incrResponseCodes(statsd StatsD, code int, tags ...string) {
+	if names.ResponseCode != "" {
+		statsd.Incr(fmt.Sprintf(names.ResponseCode, code), tags...)
+	}
+	names.incr(statsd, names.ResponseCodeAll, tags...)
+}
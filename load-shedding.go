@@ -0,0 +1,87 @@
+package tools
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadSheddingConfig configures LoadSheddingHandler. Zero values are replaced with defaults.
+type LoadSheddingConfig struct {
+	// QueueSize is the number of requests that may wait for a worker once all are busy. Defaults to 10. Set it to
+	// a negative number to not queue requests, shedding them as soon as every worker is busy.
+	QueueSize int
+	// QueueTimeout is how long a queued request waits for a worker before being shed. Defaults to 100ms.
+	QueueTimeout time.Duration
+	// RetryAfter is sent to shed clients in the Retry-After header. Defaults to 1s.
+	RetryAfter time.Duration
+}
+
+const (
+	defaultShedQueueSize    = 10
+	defaultShedQueueTimeout = 100 * time.Millisecond
+	defaultShedRetryAfter   = time.Second
+	internalPathPrefix      = "/internal/"
+)
+
+func (c LoadSheddingConfig) withDefaults() LoadSheddingConfig {
+	switch {
+	case c.QueueSize == 0:
+		c.QueueSize = defaultShedQueueSize
+	case c.QueueSize < 0:
+		c.QueueSize = 0
+	}
+	if c.QueueTimeout == 0 {
+		c.QueueTimeout = defaultShedQueueTimeout
+	}
+	if c.RetryAfter == 0 {
+		c.RetryAfter = defaultShedRetryAfter
+	}
+	return c
+}
+
+// LoadSheddingHandler bounds the number of concurrent requests to handler with worker. Once every worker is
+// busy, up to QueueSize requests wait for QueueTimeout. Anything beyond that gets a 503 with a Retry-After
+// header. Requests to /internal/ paths are never shed so health checks keep working under load.
+func LoadSheddingHandler(routeName string, worker Worker, config LoadSheddingConfig, handler http.Handler, statsd StatsD) http.Handler {
+	config = config.withDefaults()
+	queue := make(chan struct{}, config.QueueSize)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isInternalPath(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		release, ok := worker.TryAcquire(0)
+		if !ok && config.QueueSize > 0 {
+			select {
+			case queue <- struct{}{}:
+				release, ok = worker.TryAcquire(config.QueueTimeout)
+				<-queue
+			default:
+			}
+		}
+		if !ok {
+			shedRequest(w, r, routeName, config.RetryAfter, statsd)
+			return
+		}
+		defer release()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func isInternalPath(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, internalPathPrefix)
+}
+
+// shedRequest rejects a request with a 503 and records it with the same tags as HTTPHandlerWithStats
+func shedRequest(w http.ResponseWriter, r *http.Request, routeName string, retryAfter time.Duration, statsd StatsD) {
+	tags := withCallerTag([]string{"route:" + routeName, fmt.Sprintf("response:%d", http.StatusServiceUnavailable)}, r)
+	statsd.Incr(WebRequestShedKey, tags...)
+
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
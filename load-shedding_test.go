@@ -0,0 +1,92 @@
+package tools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSheddingHandler(t *testing.T) {
+
+	t.Run("should serve requests while workers are available", func(t *testing.T) {
+		worker, _ := NewWorker(1)
+		msd := &MockStatsD{}
+		handler := LoadSheddingHandler("route", worker, LoadSheddingConfig{}, &MockHandler{response: http.StatusOK}, msd)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/hello", nil))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Len(t, msd.Calls, 0)
+		assert.Equal(t, 1, worker.available())
+	})
+
+	t.Run("should shed requests once the workers and queue are full", func(t *testing.T) {
+		worker, _ := NewWorker(1)
+		msd := &MockStatsD{}
+		config := LoadSheddingConfig{QueueSize: 1, QueueTimeout: 10 * time.Millisecond, RetryAfter: 1500 * time.Millisecond}
+		handler := LoadSheddingHandler("route", worker, config, &MockHandler{response: http.StatusOK}, msd)
+		release := worker.Acquire()
+		defer release()
+
+		req := httptest.NewRequest("GET", "http://example.com/hello", nil)
+		req.Header.Set("X-Component", "my-caller")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+		assert.Len(t, msd.Calls, 1)
+		assert.Equal(t, "Incr", msd.Calls[0].Method)
+		assert.Equal(t, WebRequestShedKey, msd.Calls[0].Args.Name)
+		assert.Equal(t, []string{"route:route", "response:503", "caller:my-caller"}, msd.Calls[0].Args.Tags)
+	})
+
+	t.Run("should shed requests as soon as the workers are busy without a queue", func(t *testing.T) {
+		worker, _ := NewWorker(1)
+		config := LoadSheddingConfig{QueueSize: -1, QueueTimeout: time.Second}
+		handler := LoadSheddingHandler("route", worker, config, &MockHandler{response: http.StatusOK}, &MockStatsD{})
+		release := worker.Acquire()
+		defer release()
+
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/hello", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Less(t, time.Since(start), config.QueueTimeout, "the request should not have waited for a worker")
+	})
+
+	t.Run("should serve queued requests when a worker frees up", func(t *testing.T) {
+		worker, _ := NewWorker(1)
+		config := LoadSheddingConfig{QueueSize: 1, QueueTimeout: time.Second}
+		handler := LoadSheddingHandler("route", worker, config, &MockHandler{response: http.StatusOK}, &MockStatsD{})
+		release := worker.Acquire()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			release()
+		}()
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/hello", nil))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("should never shed internal requests", func(t *testing.T) {
+		worker, _ := NewWorker(1)
+		msd := &MockStatsD{}
+		handler := LoadSheddingHandler("route", worker, LoadSheddingConfig{}, &MockHandler{response: http.StatusOK}, msd)
+		release := worker.Acquire()
+		defer release()
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/internal/healthcheck", nil))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Len(t, msd.Calls, 0)
+	})
+}
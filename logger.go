@@ -111,20 +111,22 @@ func NewLogger(isLocal bool) Logger {
 	return &logrusLogger{
 		log: logger,
 		fields: logrus.Fields{
-			"component": getComponentName(),
-			"env":       getEnv(),
+			"component": ComponentName(),
+			"env":       EnvName(),
 		},
 	}
 }
 
-func getComponentName() string {
+// ComponentName is the name of the running component, from COMPONENT_NAME
+func ComponentName() string {
 	if name := os.Getenv("COMPONENT_NAME"); len(name) > 0 {
 		return name
 	}
 	return "a-service-has-no-name"
 }
 
-func getEnv() string {
+// EnvName is the name of the environment the component is running in, from ENV_NAME
+func EnvName() string {
 	if env := os.Getenv("ENV_NAME"); len(env) > 0 {
 		return env
 	}
@@ -1,14 +1,28 @@
 package tools
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
-// MockStatsD provides a basic mock of the MMG StatsD object. It takes a *testing.T to assert on.
+// MockStatsD records every call made to it so tests can query and assert on them. It is safe for concurrent
+// use, but Calls should only be read directly once nothing else is recording metrics; use Snapshot otherwise.
+// Flush and Close aren't recorded in Calls, but counted by Flushes and Closes.
 type MockStatsD struct {
 	Calls []Call
+
+	mu      sync.Mutex
+	texts   []textCall
+	flushes int
+	closes  int
+	changed chan struct{}
 }
 
 // Call is a single call to a StatsD method. It has the method name and the arguments it was called with
@@ -17,13 +31,20 @@ type Call struct {
 	Args   Args
 }
 
-// Args are the list of arguments to a single StatsD method
+// Args are the list of arguments to a single StatsD method. Timing values are recorded in milliseconds. Set
+// values and event and service check text are available from Texts.
 type Args struct {
 	Name  string
 	Value float64
 	Tags  []string
 }
 
+// textCall is the text of a Set, Event or ServiceCheck call
+type textCall struct {
+	name string
+	text string
+}
+
 // MockStatsDExpectation is called whenever a MockStatsD method is invoked. It will receive the
 // pointer to the test object added as Test to MockStatsD, the name of the method called, and
 // and the four arguments that a StatsD metric may receive. Assert against these values in the
@@ -50,14 +71,286 @@ func (msd *MockStatsD) Count(name string, value int64, tags ...string) {
 	msd.call("Count", name, float64(value), tags)
 }
 
+// Timing is a mock Timing method
+func (msd *MockStatsD) Timing(name string, value time.Duration, tags ...string) {
+	msd.call("Timing", name, float64(value)/float64(time.Millisecond), tags)
+}
+
+// Distribution is a mock Distribution method
+func (msd *MockStatsD) Distribution(name string, value float64, tags ...string) {
+	msd.call("Distribution", name, value, tags)
+}
+
+// Set is a mock Set method
+func (msd *MockStatsD) Set(name string, value string, tags ...string) {
+	msd.callWithText("Set", name, 0, value, tags)
+}
+
+// Decr is a mock Decr method
+func (msd *MockStatsD) Decr(name string, tags ...string) {
+	msd.call("Decr", name, 0, tags)
+}
+
+// Event is a mock Event method. The title is recorded as the name.
+func (msd *MockStatsD) Event(event *StatsDEvent) {
+	msd.callWithText("Event", event.Title, 0, event.Text, event.Tags)
+}
+
+// ServiceCheck is a mock ServiceCheck method. The status is recorded as the value.
+func (msd *MockStatsD) ServiceCheck(check *StatsDServiceCheck) {
+	msd.callWithText("ServiceCheck", check.Name, float64(check.Status), check.Message, check.Tags)
+}
+
+// Flush is a mock Flush method. It is counted by Flushes rather than recorded in Calls.
+func (msd *MockStatsD) Flush() error {
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	msd.flushes++
+	return nil
+}
+
+// Close is a mock Close method. It is counted by Closes rather than recorded in Calls.
+func (msd *MockStatsD) Close() error {
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	msd.closes++
+	return nil
+}
+
+// Flushes returns the number of times Flush has been called
+func (msd *MockStatsD) Flushes() int {
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	return msd.flushes
+}
+
+// Closes returns the number of times Close has been called
+func (msd *MockStatsD) Closes() int {
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	return msd.closes
+}
+
+// WithContext returns a StatsD that records calls in this MockStatsD with the tags carried by ctx added
+func (msd *MockStatsD) WithContext(ctx context.Context) StatsD {
+	return withContext(msd, ctx)
+}
+
+// WithPrefix returns a StatsD that records calls in this MockStatsD with prefix added to the names
+func (msd *MockStatsD) WithPrefix(prefix string) StatsD {
+	return withPrefix(msd, prefix)
+}
+
+// WithTags returns a StatsD that records calls in this MockStatsD with tags added
+func (msd *MockStatsD) WithTags(tags ...string) StatsD {
+	return withTags(msd, tags...)
+}
+
+// StartTimer starts a Timer that records its histogram in this MockStatsD
+func (msd *MockStatsD) StartTimer(name string, tags ...string) *Timer {
+	return StartTimer(msd, name, tags...)
+}
+
+// Call returns the first call made
 func (msd *MockStatsD) Call() (c Call, err error) {
-	fmt.Println(msd.Calls)
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
 	if len(msd.Calls) == 0 {
 		return c, errors.New("No calls made")
 	}
 	return msd.Calls[0], nil
 }
 
+// LastCall returns the most recent call made, or nil if there haven't been any
+func (msd *MockStatsD) LastCall() *Call {
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	if len(msd.Calls) == 0 {
+		return nil
+	}
+	c := msd.Calls[len(msd.Calls)-1]
+	return &c
+}
+
+// Snapshot returns a copy of the calls made so far
+func (msd *MockStatsD) Snapshot() []Call {
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	return slices.Clone(msd.Calls)
+}
+
+// Reset forgets every call made so far
+func (msd *MockStatsD) Reset() {
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	msd.Calls = nil
+	msd.texts = nil
+	msd.flushes = 0
+	msd.closes = 0
+}
+
+// CountOf returns the number of calls for the metric name that have all of tags
+func (msd *MockStatsD) CountOf(name string, tags ...string) int {
+	return len(msd.matching(name, tags))
+}
+
+// Values returns the value of every call for the metric name, in the order they were made
+func (msd *MockStatsD) Values(name string) []float64 {
+	calls := msd.matching(name, nil)
+	values := make([]float64, len(calls))
+	for i, c := range calls {
+		values[i] = c.Args.Value
+	}
+	return values
+}
+
+// Texts returns the text of every Set, Event and ServiceCheck call for name, i.e. the Set value, the event text
+// or the service check message, in the order they were made
+func (msd *MockStatsD) Texts(name string) []string {
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	var texts []string
+	for _, c := range msd.texts {
+		if c.name == name {
+			texts = append(texts, c.text)
+		}
+	}
+	return texts
+}
+
+// HasTag reports whether any call for the metric name had tag
+func (msd *MockStatsD) HasTag(name, tag string) bool {
+	return msd.CountOf(name, tag) > 0
+}
+
+// WaitFor waits up to timeout for a call for the metric name that has all of tags, for metrics that are
+// recorded from another goroutine. It reports whether one was made.
+func (msd *MockStatsD) WaitFor(name string, timeout time.Duration, tags ...string) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		msd.mu.Lock()
+		found := slices.ContainsFunc(msd.Calls, func(c Call) bool { return c.matches(name, tags) })
+		if msd.changed == nil {
+			msd.changed = make(chan struct{})
+		}
+		changed := msd.changed
+		msd.mu.Unlock()
+
+		if found {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// tHelper is implemented by *testing.T, so assertion failures are reported at the caller's line
+type tHelper interface {
+	Helper()
+}
+
+// AssertCalled asserts that there was at least one call for the metric name that had all of tags
+func (msd *MockStatsD) AssertCalled(t assert.TestingT, name string, tags ...string) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	if msd.CountOf(name, tags...) > 0 {
+		return true
+	}
+	return assert.Fail(t, fmt.Sprintf("Expected a call for %s with tags %v", name, tags), msd.describe())
+}
+
+// AssertNotCalled asserts that there weren't any calls for the metric name that had all of tags
+func (msd *MockStatsD) AssertNotCalled(t assert.TestingT, name string, tags ...string) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	if msd.CountOf(name, tags...) == 0 {
+		return true
+	}
+	return assert.Fail(t, fmt.Sprintf("Expected no calls for %s with tags %v", name, tags), msd.describe())
+}
+
+// AssertCount asserts the number of calls for the metric name that had all of tags
+func (msd *MockStatsD) AssertCount(t assert.TestingT, name string, expected int, tags ...string) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	if actual := msd.CountOf(name, tags...); actual != expected {
+		return assert.Fail(t, fmt.Sprintf("Expected %d calls for %s with tags %v, got %d", expected, name, tags, actual), msd.describe())
+	}
+	return true
+}
+
+// AssertValues asserts the values of every call for the metric name, in the order they were made
+func (msd *MockStatsD) AssertValues(t assert.TestingT, name string, expected ...float64) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	return assert.Equal(t, expected, msd.Values(name), "Values for %s", name)
+}
+
+// AssertEventually asserts that a call for the metric name that had all of tags is made within timeout
+func (msd *MockStatsD) AssertEventually(t assert.TestingT, name string, timeout time.Duration, tags ...string) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	if msd.WaitFor(name, timeout, tags...) {
+		return true
+	}
+	return assert.Fail(t, fmt.Sprintf("Expected a call for %s with tags %v within %s", name, tags, timeout), msd.describe())
+}
+
+func (msd *MockStatsD) matching(name string, tags []string) []Call {
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	var calls []Call
+	for _, c := range msd.Calls {
+		if c.matches(name, tags) {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+func (msd *MockStatsD) describe() string {
+	return fmt.Sprintf("Calls made: %v", msd.Snapshot())
+}
+
 func (msd *MockStatsD) call(method string, name string, value float64, tags []string) {
-	msd.Calls = append(msd.Calls, Call{method, Args{name, value, tags}})
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	msd.record(Call{method, Args{name, value, tags}})
+}
+
+func (msd *MockStatsD) callWithText(method string, name string, value float64, text string, tags []string) {
+	msd.mu.Lock()
+	defer msd.mu.Unlock()
+	msd.texts = append(msd.texts, textCall{name, text})
+	msd.record(Call{method, Args{name, value, tags}})
+}
+
+// record adds c to the calls and wakes anything waiting for it. It must be called with the lock held.
+func (msd *MockStatsD) record(c Call) {
+	msd.Calls = append(msd.Calls, c)
+	if msd.changed != nil {
+		close(msd.changed)
+		msd.changed = nil
+	}
+}
+
+func (c Call) matches(name string, tags []string) bool {
+	if c.Args.Name != name {
+		return false
+	}
+	for _, tag := range tags {
+		if !slices.Contains(c.Args.Tags, tag) {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,149 @@
+package tools
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failureRecorder struct {
+	failures []string
+	helpers  int
+}
+
+func (f *failureRecorder) Helper() {
+	f.helpers++
+}
+
+func (f *failureRecorder) Errorf(format string, args ...interface{}) {
+	f.failures = append(f.failures, format)
+}
+
+func TestMockStatsD(t *testing.T) {
+
+	t.Run("should query calls by name and tags", func(t *testing.T) {
+		msd := &MockStatsD{}
+
+		msd.Histogram("web.response_time", 10, "route:/a", "response:200")
+		msd.Histogram("web.response_time", 20, "route:/b", "response:200")
+		msd.Incr("web.response_code.all", "route:/a")
+
+		assert.Equal(t, 2, msd.CountOf("web.response_time"))
+		assert.Equal(t, 1, msd.CountOf("web.response_time", "route:/a", "response:200"))
+		assert.Equal(t, 0, msd.CountOf("web.response_time", "route:/a", "response:500"))
+		assert.Equal(t, []float64{10, 20}, msd.Values("web.response_time"))
+		assert.True(t, msd.HasTag("web.response_code.all", "route:/a"))
+		assert.False(t, msd.HasTag("web.response_code.all", "route:/b"))
+		assert.Equal(t, "web.response_code.all", msd.LastCall().Args.Name)
+	})
+
+	t.Run("should keep the text of sets, events and service checks apart from the calls", func(t *testing.T) {
+		msd := &MockStatsD{}
+
+		msd.Set("users", "a", "route:/a")
+		msd.Event(&StatsDEvent{Title: "deployed", Text: "v1.2"})
+		msd.ServiceCheck(&StatsDServiceCheck{Name: "search.up", Status: ServiceCheckCritical, Message: "down"})
+		msd.Set("users", "b")
+
+		assert.Equal(t, Call{"Set", Args{"users", 0, []string{"route:/a"}}}, msd.Calls[0])
+		assert.Equal(t, []string{"a", "b"}, msd.Texts("users"))
+		assert.Equal(t, []string{"v1.2"}, msd.Texts("deployed"))
+		assert.Equal(t, []string{"down"}, msd.Texts("search.up"))
+	})
+
+	t.Run("should count flushes and closes apart from the calls", func(t *testing.T) {
+		msd := &MockStatsD{}
+		msd.Incr("requests")
+
+		assert.NoError(t, msd.Flush())
+		assert.NoError(t, msd.Flush())
+		assert.NoError(t, msd.Close())
+
+		assert.Len(t, msd.Calls, 1)
+		assert.Equal(t, 2, msd.Flushes())
+		assert.Equal(t, 1, msd.Closes())
+	})
+
+	t.Run("should forget calls on reset", func(t *testing.T) {
+		msd := &MockStatsD{}
+		msd.Incr("requests")
+		msd.Set("users", "a")
+
+		msd.Reset()
+
+		assert.Empty(t, msd.Texts("users"))
+		assert.Empty(t, msd.Snapshot())
+		assert.Nil(t, msd.LastCall())
+		_, err := msd.Call()
+		assert.Error(t, err)
+	})
+
+	t.Run("should record calls from many goroutines", func(t *testing.T) {
+		msd := &MockStatsD{}
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				msd.Incr("requests")
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, 50, msd.CountOf("requests"))
+	})
+
+	t.Run("should wait for metrics recorded in the background", func(t *testing.T) {
+		msd := &MockStatsD{}
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			msd.Incr("other")
+			msd.Gauge("queue.depth", 3, "queue:a")
+		}()
+
+		assert.True(t, msd.WaitFor("queue.depth", time.Second, "queue:a"))
+		assert.False(t, msd.WaitFor("queue.depth", 10*time.Millisecond, "queue:b"))
+	})
+
+	t.Run("should pass assertions that hold", func(t *testing.T) {
+		msd := &MockStatsD{}
+		msd.Count("requests", 2, "route:/a")
+		msd.Count("requests", 3, "route:/a")
+
+		msd.AssertCalled(t, "requests", "route:/a")
+		msd.AssertNotCalled(t, "requests", "route:/b")
+		msd.AssertCount(t, "requests", 2, "route:/a")
+		msd.AssertValues(t, "requests", 2, 3)
+		msd.AssertEventually(t, "requests", time.Millisecond)
+	})
+
+	t.Run("should fail assertions that don't hold", func(t *testing.T) {
+		msd := &MockStatsD{}
+		msd.Incr("requests", "route:/a")
+		recorder := &failureRecorder{}
+
+		assert.False(t, msd.AssertCalled(recorder, "requests", "route:/b"))
+		assert.False(t, msd.AssertNotCalled(recorder, "requests"))
+		assert.False(t, msd.AssertCount(recorder, "requests", 2))
+		assert.False(t, msd.AssertValues(recorder, "requests", 1))
+		assert.False(t, msd.AssertEventually(recorder, "missing", time.Millisecond))
+		assert.Len(t, recorder.failures, 5)
+	})
+
+	t.Run("should mark assertions as test helpers", func(t *testing.T) {
+		msd := &MockStatsD{}
+		msd.Incr("requests")
+		recorder := &failureRecorder{}
+
+		msd.AssertCalled(recorder, "requests")
+		msd.AssertNotCalled(recorder, "missing")
+		msd.AssertCount(recorder, "requests", 1)
+		msd.AssertValues(recorder, "requests", 0)
+		msd.AssertEventually(recorder, "requests", time.Millisecond)
+
+		assert.Empty(t, recorder.failures)
+		assert.GreaterOrEqual(t, recorder.helpers, 5)
+	})
+}
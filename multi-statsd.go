@@ -0,0 +1,344 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMultiStatsDQueueSize = 1000
+	multiStatsDDropWarnInterval = time.Minute
+)
+
+// MetricRewrite changes the name and tags of a metric before it is sent to a backend. Return keep=false to
+// not send the metric to that backend at all. The tags can be modified in place.
+type MetricRewrite func(name string, tags []string) (newName string, newTags []string, keep bool)
+
+// MultiStatsDBackend is one of the StatsDs that a MultiStatsD sends metrics to
+type MultiStatsDBackend struct {
+	// Name identifies the backend in logs
+	Name   string
+	StatsD StatsD
+	// Rewrite is applied to every metric before it is sent to this backend. It is optional.
+	Rewrite MetricRewrite
+	// QueueSize is the number of metrics that can wait to be sent to this backend before new ones are
+	// dropped. Defaults to 1000.
+	QueueSize int
+}
+
+// MultiStatsD is a StatsD that sends every metric to several backends, e.g. to Datadog and Prometheus during
+// a migration. Each backend has its own queue and goroutine, so a slow backend only drops its own metrics
+// once its queue is full, and a backend that panics doesn't affect the others.
+type MultiStatsD struct {
+	backends []*multiStatsDBackend
+}
+
+type multiStatsDBackend struct {
+	MultiStatsDBackend
+	log          Logger
+	mu           sync.RWMutex
+	closed       bool
+	queue        chan func()
+	stop         chan struct{}
+	done         chan struct{}
+	dropped      atomic.Int64
+	lastDropWarn atomic.Int64
+}
+
+// NewMultiStatsD creates a MultiStatsD that sends metrics to each of backends. Dropped metrics and panics in
+// backends are reported to log.
+func NewMultiStatsD(log Logger, backends ...MultiStatsDBackend) *MultiStatsD {
+	m := &MultiStatsD{}
+	for _, backend := range backends {
+		if backend.QueueSize == 0 {
+			backend.QueueSize = defaultMultiStatsDQueueSize
+		}
+		b := &multiStatsDBackend{
+			MultiStatsDBackend: backend,
+			log:                log,
+			queue:              make(chan func(), backend.QueueSize),
+			stop:               make(chan struct{}),
+			done:               make(chan struct{}),
+		}
+		go b.run()
+		m.backends = append(m.backends, b)
+	}
+	return m
+}
+
+// Histogram sends a histogram to every backend
+func (m *MultiStatsD) Histogram(name string, value float64, tags ...string) {
+	m.dispatch(name, tags, func(sd StatsD, name string, tags []string) { sd.Histogram(name, value, tags...) })
+}
+
+// Gauge sends a gauge to every backend
+func (m *MultiStatsD) Gauge(name string, value float64, tags ...string) {
+	m.dispatch(name, tags, func(sd StatsD, name string, tags []string) { sd.Gauge(name, value, tags...) })
+}
+
+// Incr sends an increment to every backend
+func (m *MultiStatsD) Incr(name string, tags ...string) {
+	m.dispatch(name, tags, func(sd StatsD, name string, tags []string) { sd.Incr(name, tags...) })
+}
+
+// Count sends a count to every backend
+func (m *MultiStatsD) Count(name string, value int64, tags ...string) {
+	m.dispatch(name, tags, func(sd StatsD, name string, tags []string) { sd.Count(name, value, tags...) })
+}
+
+// Timing sends a timing to every backend
+func (m *MultiStatsD) Timing(name string, value time.Duration, tags ...string) {
+	m.dispatch(name, tags, func(sd StatsD, name string, tags []string) { sd.Timing(name, value, tags...) })
+}
+
+// Distribution sends a distribution to every backend
+func (m *MultiStatsD) Distribution(name string, value float64, tags ...string) {
+	m.dispatch(name, tags, func(sd StatsD, name string, tags []string) { sd.Distribution(name, value, tags...) })
+}
+
+// Set sends a set value to every backend
+func (m *MultiStatsD) Set(name string, value string, tags ...string) {
+	m.dispatch(name, tags, func(sd StatsD, name string, tags []string) { sd.Set(name, value, tags...) })
+}
+
+// Decr sends a decrement to every backend
+func (m *MultiStatsD) Decr(name string, tags ...string) {
+	m.dispatch(name, tags, func(sd StatsD, name string, tags []string) { sd.Decr(name, tags...) })
+}
+
+// Event sends an event to every backend. Rewrites are applied to its title and tags.
+func (m *MultiStatsD) Event(event *StatsDEvent) {
+	e := *event
+	m.dispatch(e.Title, e.Tags, func(sd StatsD, title string, tags []string) {
+		e := e
+		e.Title, e.Tags = title, tags
+		sd.Event(&e)
+	})
+}
+
+// ServiceCheck sends a service check to every backend. Rewrites are applied to its name and tags.
+func (m *MultiStatsD) ServiceCheck(check *StatsDServiceCheck) {
+	sc := *check
+	m.dispatch(sc.Name, sc.Tags, func(sd StatsD, name string, tags []string) {
+		sc := sc
+		sc.Name, sc.Tags = name, tags
+		sd.ServiceCheck(&sc)
+	})
+}
+
+// Flush waits for every backend to send its queued metrics and then flushes it
+func (m *MultiStatsD) Flush() error {
+	return m.eachBackend((*multiStatsDBackend).flush)
+}
+
+// Close sends any queued metrics, then closes every backend. Metrics recorded after Close are dropped.
+func (m *MultiStatsD) Close() error {
+	return m.eachBackend((*multiStatsDBackend).close)
+}
+
+// WithContext returns a StatsD that adds the tags carried by ctx to every metric, before any rewrites
+func (m *MultiStatsD) WithContext(ctx context.Context) StatsD {
+	return withContext(m, ctx)
+}
+
+// WithPrefix returns a StatsD that adds prefix to the name of every metric, before any rewrites
+func (m *MultiStatsD) WithPrefix(prefix string) StatsD {
+	return withPrefix(m, prefix)
+}
+
+// WithTags returns a StatsD that adds tags to every metric, before any rewrites
+func (m *MultiStatsD) WithTags(tags ...string) StatsD {
+	return withTags(m, tags...)
+}
+
+func (m *MultiStatsD) StartTimer(name string, tags ...string) *Timer {
+	return StartTimer(m, name, tags...)
+}
+
+// errorCounts adds up the error counts of the backends that count failures
+func (m *MultiStatsD) errorCounts() (sent, failed int64, ok bool) {
+	for _, b := range m.backends {
+		if backendSent, backendFailed, backendOK := errorCountsOf(b.StatsD); backendOK {
+			sent, failed, ok = sent+backendSent, failed+backendFailed, true
+		}
+	}
+	return sent, failed, ok
+}
+
+func (m *MultiStatsD) dispatch(name string, tags []string, send func(sd StatsD, name string, tags []string)) {
+	for _, b := range m.backends {
+		backendTags := append([]string{}, tags...)
+		b.enqueue(func() {
+			b.safely(func() error {
+				name, tags, keep := name, backendTags, true
+				if b.Rewrite != nil {
+					name, tags, keep = b.Rewrite(name, tags)
+				}
+				if keep {
+					send(b.StatsD, name, tags)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func (m *MultiStatsD) eachBackend(fn func(*multiStatsDBackend) error) error {
+	errs := make([]error, len(m.backends))
+	var wg sync.WaitGroup
+	for i, b := range m.backends {
+		wg.Add(1)
+		go func(i int, b *multiStatsDBackend) {
+			defer wg.Done()
+			errs[i] = fn(b)
+		}(i, b)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// run sends queued metrics until the backend is stopped, and then sends whatever is left in the queue. The queue
+// is never closed, so that flush can wait for room in it without holding the lock.
+func (b *multiStatsDBackend) run() {
+	defer close(b.done)
+	for {
+		select {
+		case op := <-b.queue:
+			op()
+		case <-b.stop:
+			for {
+				select {
+				case op := <-b.queue:
+					op()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *multiStatsDBackend) enqueue(op func()) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- op:
+	default:
+		b.drop()
+	}
+}
+
+// drop counts a metric that didn't fit in the queue, and warns about it at most once a minute
+func (b *multiStatsDBackend) drop() {
+	dropped := b.dropped.Add(1)
+	now := time.Now().UnixNano()
+	last := b.lastDropWarn.Load()
+	if now-last < int64(multiStatsDDropWarnInterval) || !b.lastDropWarn.CompareAndSwap(last, now) {
+		return
+	}
+	b.dropped.Add(-dropped)
+	b.log.Warnf("StatsD backend %s is falling behind, dropped %d metrics", b.Name, dropped)
+}
+
+func (b *multiStatsDBackend) flush() error {
+	result := make(chan error, 1)
+	b.mu.RLock()
+	closed := b.closed
+	b.mu.RUnlock()
+	if closed {
+		return nil
+	}
+	// Waiting for room in a full queue mustn't hold the lock, or a concurrent close would block every metric
+	select {
+	case b.queue <- func() { result <- b.safely(b.StatsD.Flush) }:
+	case <-b.stop:
+		return nil
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-b.done:
+		return nil
+	}
+}
+
+func (b *multiStatsDBackend) close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.stop)
+	b.mu.Unlock()
+
+	<-b.done
+	return b.safely(b.StatsD.Close)
+}
+
+// safely calls fn, turning a panic into an error so that one backend can't take down the others
+func (b *multiStatsDBackend) safely(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("StatsD backend %s panicked: %v", b.Name, r)
+			b.log.Error(err.Error())
+		}
+	}()
+	return fn()
+}
+
+// RenameMetrics is a MetricRewrite that renames the metrics in names, from the key to the value, and leaves
+// any others as they are
+func RenameMetrics(names map[string]string) MetricRewrite {
+	return func(name string, tags []string) (string, []string, bool) {
+		if newName, ok := names[name]; ok {
+			return newName, tags, true
+		}
+		return name, tags, true
+	}
+}
+
+// DropTags is a MetricRewrite that removes tags with any of the given keys, e.g. high cardinality tags that
+// are affordable in one backend but not another
+func DropTags(keys ...string) MetricRewrite {
+	return func(name string, tags []string) (string, []string, bool) {
+		kept := tags[:0]
+		for _, tag := range tags {
+			if !tagHasKey(tag, keys) {
+				kept = append(kept, tag)
+			}
+		}
+		return name, kept, true
+	}
+}
+
+// ChainRewrites is a MetricRewrite that applies each of rewrites in turn, stopping if one drops the metric
+func ChainRewrites(rewrites ...MetricRewrite) MetricRewrite {
+	return func(name string, tags []string) (string, []string, bool) {
+		keep := true
+		for _, rewrite := range rewrites {
+			if name, tags, keep = rewrite(name, tags); !keep {
+				break
+			}
+		}
+		return name, tags, keep
+	}
+}
+
+func tagHasKey(tag string, keys []string) bool {
+	key, _, _ := strings.Cut(tag, ":")
+	for _, k := range keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
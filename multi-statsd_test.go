@@ -0,0 +1,178 @@
+package tools
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type panickingStatsD struct {
+	MockStatsD
+}
+
+func (p *panickingStatsD) Incr(string, ...string) {
+	panic("boom")
+}
+
+type blockingStatsD struct {
+	MockStatsD
+	unblock chan struct{}
+}
+
+func (b *blockingStatsD) Incr(name string, tags ...string) {
+	<-b.unblock
+	b.MockStatsD.Incr(name, tags...)
+}
+
+type failingFlushStatsD struct {
+	MockStatsD
+}
+
+func (f *failingFlushStatsD) Flush() error {
+	return errors.New("flush failed")
+}
+
+func TestMultiStatsD(t *testing.T) {
+
+	t.Run("should send every metric to every backend", func(t *testing.T) {
+		first, second := &MockStatsD{}, &MockStatsD{}
+		m := NewMultiStatsD(&MockLogger{}, MultiStatsDBackend{Name: "first", StatsD: first}, MultiStatsDBackend{Name: "second", StatsD: second})
+
+		m.Histogram("histogram", 1.5, "tag:a")
+		m.Incr("incr")
+		m.Event(&StatsDEvent{Title: "deployed", Tags: []string{"tag:b"}})
+		m.ServiceCheck(&StatsDServiceCheck{Name: "check", Status: ServiceCheckWarning})
+
+		assert.NoError(t, m.Flush())
+		for _, msd := range []*MockStatsD{first, second} {
+			assert.Len(t, msd.Calls, 4)
+			assert.Equal(t, Call{"Histogram", Args{"histogram", 1.5, []string{"tag:a"}}}, msd.Calls[0])
+			assert.Equal(t, "Incr", msd.Calls[1].Method)
+			assert.Equal(t, Call{"Event", Args{"deployed", 0, []string{"tag:b"}}}, msd.Calls[2])
+			assert.Equal(t, Call{"ServiceCheck", Args{"check", 1, []string{}}}, msd.Calls[3])
+			assert.Equal(t, 1, msd.Flushes())
+		}
+	})
+
+	t.Run("should apply rewrites to each backend separately", func(t *testing.T) {
+		datadog, prometheus := &MockStatsD{}, &MockStatsD{}
+		rewrite := ChainRewrites(
+			RenameMetrics(map[string]string{"web.response_time": "http.server.duration"}),
+			DropTags("caller"),
+			func(name string, tags []string) (string, []string, bool) { return name, tags, name != "debug" },
+		)
+		m := NewMultiStatsD(&MockLogger{},
+			MultiStatsDBackend{Name: "datadog", StatsD: datadog},
+			MultiStatsDBackend{Name: "prometheus", StatsD: prometheus, Rewrite: rewrite},
+		)
+		tags := []string{"route:/hello", "caller:my-caller"}
+
+		m.Histogram("web.response_time", 10, tags...)
+		m.Incr("debug")
+
+		assert.NoError(t, m.Flush())
+		assert.Equal(t, []string{"route:/hello", "caller:my-caller"}, tags)
+		assert.Len(t, datadog.Calls, 2)
+		assert.Equal(t, Args{"web.response_time", 10, []string{"route:/hello", "caller:my-caller"}}, datadog.Calls[0].Args)
+		assert.Len(t, prometheus.Calls, 1)
+		assert.Equal(t, Args{"http.server.duration", 10, []string{"route:/hello"}}, prometheus.Calls[0].Args)
+	})
+
+	t.Run("should isolate a panicking backend", func(t *testing.T) {
+		logger := &MockLogger{}
+		healthy := &MockStatsD{}
+		m := NewMultiStatsD(logger,
+			MultiStatsDBackend{Name: "broken", StatsD: &panickingStatsD{}},
+			MultiStatsDBackend{Name: "healthy", StatsD: healthy},
+		)
+
+		m.Incr("incr")
+		m.Gauge("gauge", 1)
+
+		assert.NoError(t, m.Flush())
+		assert.Len(t, healthy.Calls, 2)
+		call, _ := logger.Call()
+		assert.Equal(t, "Error", call.Method)
+	})
+
+	t.Run("should drop metrics for a slow backend without blocking the others", func(t *testing.T) {
+		logger := &MockLogger{}
+		slow := &blockingStatsD{unblock: make(chan struct{})}
+		fast := &MockStatsD{}
+		m := NewMultiStatsD(logger,
+			MultiStatsDBackend{Name: "slow", StatsD: slow, QueueSize: 1},
+			MultiStatsDBackend{Name: "fast", StatsD: fast},
+		)
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 10; i++ {
+				m.Incr("incr")
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("recording metrics blocked on the slow backend")
+		}
+		close(slow.unblock)
+
+		assert.NoError(t, m.Close())
+		assert.Len(t, fast.Calls, 10)
+		assert.Equal(t, 1, fast.Closes())
+		assert.Less(t, len(slow.Calls), 10)
+		call, _ := logger.Call()
+		assert.Equal(t, "Warn", call.Method)
+		assert.Contains(t, call.Args.Msg, "StatsD backend slow is falling behind")
+	})
+
+	t.Run("should keep recording metrics while a flush waits for a full queue", func(t *testing.T) {
+		slow := &blockingStatsD{unblock: make(chan struct{})}
+		m := NewMultiStatsD(&MockLogger{}, MultiStatsDBackend{Name: "slow", StatsD: slow, QueueSize: 1})
+		m.Incr("running")
+		time.Sleep(50 * time.Millisecond) // let the backend start sending it
+		m.Incr("queued")
+
+		flushed := make(chan error)
+		go func() { flushed <- m.Flush() }()
+		time.Sleep(50 * time.Millisecond) // let the flush start waiting for room in the queue
+		closed := make(chan error)
+		go func() { closed <- m.Close() }()
+		time.Sleep(50 * time.Millisecond)
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 10; i++ {
+				m.Incr("incr")
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("recording metrics blocked on a flush")
+		}
+		close(slow.unblock)
+
+		assert.NoError(t, <-flushed)
+		assert.NoError(t, <-closed)
+	})
+
+	t.Run("should return flush errors and close every backend", func(t *testing.T) {
+		first, second := &failingFlushStatsD{}, &MockStatsD{}
+		m := NewMultiStatsD(&MockLogger{}, MultiStatsDBackend{Name: "first", StatsD: first}, MultiStatsDBackend{Name: "second", StatsD: second})
+
+		assert.EqualError(t, m.Flush(), "flush failed")
+		assert.NoError(t, m.Close())
+		m.Incr("after-close")
+		assert.NoError(t, m.Flush())
+
+		assert.Equal(t, 1, first.Closes())
+		assert.Empty(t, second.Calls)
+		assert.Equal(t, 1, second.Flushes())
+		assert.Equal(t, 1, second.Closes())
+	})
+}
@@ -0,0 +1,327 @@
+// Package otelstatsd implements tools.StatsD with OpenTelemetry metrics. It is separate from tools so that
+// services that don't use OpenTelemetry don't depend on it.
+package otelstatsd
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	tools "github.com/mergermarket/gotools"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+const (
+	otelInstrumentationName = "github.com/mergermarket/gotools/otelstatsd"
+	otelEventsName          = "events"
+	otelServiceCheckName    = "service_check.status"
+	otelMillisecondsUnit    = "ms"
+	otelTagWithoutValue     = "true"
+)
+
+// otelStatsD is a StatsD that records metrics with an OpenTelemetry Meter
+type otelStatsD struct {
+	namespace      string
+	tags           []string
+	log            tools.Logger
+	provider       *sdkmetric.MeterProvider
+	upDown         map[string]bool
+	dropped        sync.Map
+	counters       *otelInstruments[metric.Int64Counter]
+	upDownCounters *otelInstruments[metric.Int64UpDownCounter]
+	histograms     *otelInstruments[metric.Float64Histogram]
+	timings        *otelInstruments[metric.Float64Histogram]
+	gauges         *otelInstruments[metric.Float64Gauge]
+	setsMu         sync.Mutex
+	sets           map[otelSetKey]map[string]struct{}
+}
+
+type otelSetKey struct {
+	name  string
+	attrs attribute.Distinct
+}
+
+// Option configures optional behaviour of New and NewOTLP
+type Option func(*otelOptions)
+
+type otelOptions struct {
+	upDownCounters []string
+	exporter       []otlpmetrichttp.Option
+}
+
+// WithUpDownCounters records the counters with names, e.g. the number of requests in flight, as up-down counters,
+// so Decr and negative counts lower them. Names include any prefix but not the namespace.
+func WithUpDownCounters(names ...string) Option {
+	return func(o *otelOptions) {
+		o.upDownCounters = append(o.upDownCounters, names...)
+	}
+}
+
+// WithExporterOptions configures the OTLP exporter created by NewOTLP, instead of the OTEL_EXPORTER_OTLP_*
+// environment variables
+func WithExporterOptions(opts ...otlpmetrichttp.Option) Option {
+	return func(o *otelOptions) {
+		o.exporter = append(o.exporter, opts...)
+	}
+}
+
+// New creates a StatsD that forwards metrics to an OpenTelemetry meter, so code instrumented with
+// StatsD emits OTel metrics without changes. Tags become attributes, with tags without a value set to "true".
+//
+//   - Incr and Count add to a counter, or to an up-down counter for names given to WithUpDownCounters. Counters
+//     can't go down, so Decr and negative counts of other names are dropped, with a warning logged once per name.
+//   - Gauge records a gauge.
+//   - Histogram and Distribution record a histogram, and Timing records a histogram in milliseconds.
+//   - Set records a gauge of the number of distinct values seen, so it should only be used with a few values.
+//   - Event adds to an events counter by alert_type and ServiceCheck records a service_check.status gauge.
+//
+// The namespace and global tags are taken from config like tools.NewStatsD. The env and component tags are left
+// to the meter provider's resource. Flush and Close do nothing, as the meter provider belongs to the caller.
+func New(meter metric.Meter, config tools.StatsDConfig, opts ...Option) tools.StatsD {
+	return newOTelStatsD(meter, config, newOTelOptions(opts))
+}
+
+// NewOTLP creates a StatsD that exports metrics to an OpenTelemetry collector with OTLP over HTTP. The
+// collector is configured with the standard OTEL_EXPORTER_OTLP_* environment variables, unless
+// WithExporterOptions is given. The component and env are set as the service.name and deployment.environment
+// resource attributes. Flush exports straight away and Close shuts the exporter down.
+func NewOTLP(ctx context.Context, config tools.StatsDConfig, opts ...Option) (tools.StatsD, error) {
+	options := newOTelOptions(opts)
+	exporter, err := otlpmetrichttp.New(ctx, options.exporter...)
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewSchemaless(
+		attribute.String("service.name", tools.ComponentName()),
+		attribute.String("deployment.environment", tools.EnvName()),
+	)
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(res),
+	)
+	sd := newOTelStatsD(provider.Meter(otelInstrumentationName), config, options)
+	sd.provider = provider
+	return sd, nil
+}
+
+func newOTelOptions(opts []Option) otelOptions {
+	var options otelOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+func newOTelStatsD(meter metric.Meter, config tools.StatsDConfig, options otelOptions) *otelStatsD {
+	sd := &otelStatsD{
+		namespace: config.Namespace(),
+		tags:      config.GlobalTags(),
+		log:       config.Logger(),
+		upDown:    make(map[string]bool, len(options.upDownCounters)),
+		sets:      make(map[otelSetKey]map[string]struct{}),
+	}
+	for _, name := range options.upDownCounters {
+		sd.upDown[name] = true
+	}
+	sd.counters = newOTelInstruments(sd, func(name string) (metric.Int64Counter, error) {
+		return meter.Int64Counter(name)
+	})
+	sd.upDownCounters = newOTelInstruments(sd, func(name string) (metric.Int64UpDownCounter, error) {
+		return meter.Int64UpDownCounter(name)
+	})
+	sd.histograms = newOTelInstruments(sd, func(name string) (metric.Float64Histogram, error) {
+		return meter.Float64Histogram(name)
+	})
+	sd.timings = newOTelInstruments(sd, func(name string) (metric.Float64Histogram, error) {
+		return meter.Float64Histogram(name, metric.WithUnit(otelMillisecondsUnit))
+	})
+	sd.gauges = newOTelInstruments(sd, func(name string) (metric.Float64Gauge, error) {
+		return meter.Float64Gauge(name)
+	})
+	return sd
+}
+
+func (o *otelStatsD) Histogram(name string, value float64, tags ...string) {
+	if h, ok := o.histograms.get(o.namespace + name); ok {
+		h.Record(context.Background(), value, o.attributes(tags))
+	}
+}
+
+func (o *otelStatsD) Gauge(name string, value float64, tags ...string) {
+	if g, ok := o.gauges.get(o.namespace + name); ok {
+		g.Record(context.Background(), value, o.attributes(tags))
+	}
+}
+
+func (o *otelStatsD) Incr(name string, tags ...string) {
+	o.Count(name, 1, tags...)
+}
+
+func (o *otelStatsD) Count(name string, value int64, tags ...string) {
+	if o.upDown[name] {
+		if c, ok := o.upDownCounters.get(o.namespace + name); ok {
+			c.Add(context.Background(), value, o.attributes(tags))
+		}
+		return
+	}
+	if value < 0 {
+		o.warnDropped(name)
+		return
+	}
+	if c, ok := o.counters.get(o.namespace + name); ok {
+		c.Add(context.Background(), value, o.attributes(tags))
+	}
+}
+
+func (o *otelStatsD) Timing(name string, value time.Duration, tags ...string) {
+	if h, ok := o.timings.get(o.namespace + name); ok {
+		h.Record(context.Background(), float64(value.Nanoseconds())/1000000, o.attributes(tags))
+	}
+}
+
+func (o *otelStatsD) Distribution(name string, value float64, tags ...string) {
+	o.Histogram(name, value, tags...)
+}
+
+func (o *otelStatsD) Set(name string, value string, tags ...string) {
+	g, ok := o.gauges.get(o.namespace + name)
+	if !ok {
+		return
+	}
+	attrs := attribute.NewSet(o.keyValues(tags)...)
+	key := otelSetKey{name, attrs.Equivalent()}
+
+	o.setsMu.Lock()
+	seen, ok := o.sets[key]
+	if !ok {
+		seen = make(map[string]struct{})
+		o.sets[key] = seen
+	}
+	seen[value] = struct{}{}
+	distinct := len(seen)
+	o.setsMu.Unlock()
+
+	g.Record(context.Background(), float64(distinct), metric.WithAttributeSet(attrs))
+}
+
+// Decr subtracts one from an up-down counter. It is dropped for other counters, as they can't go down.
+func (o *otelStatsD) Decr(name string, tags ...string) {
+	o.Count(name, -1, tags...)
+}
+
+func (o *otelStatsD) Event(event *tools.StatsDEvent) {
+	alertType := event.AlertType
+	if alertType == "" {
+		alertType = tools.EventAlertInfo
+	}
+	o.Incr(otelEventsName, append([]string{"alert_type:" + string(alertType)}, event.Tags...)...)
+}
+
+func (o *otelStatsD) ServiceCheck(check *tools.StatsDServiceCheck) {
+	o.Gauge(otelServiceCheckName, float64(check.Status), append([]string{"check:" + check.Name}, check.Tags...)...)
+}
+
+func (o *otelStatsD) Flush() error {
+	if o.provider == nil {
+		return nil
+	}
+	return o.provider.ForceFlush(context.Background())
+}
+
+func (o *otelStatsD) Close() error {
+	if o.provider == nil {
+		return nil
+	}
+	return o.provider.Shutdown(context.Background())
+}
+
+func (o *otelStatsD) WithContext(ctx context.Context) tools.StatsD {
+	tags := tools.TagsFromContext(ctx)
+	if len(tags) == 0 {
+		return o
+	}
+	return tools.ScopeStatsD(o, "", tags...)
+}
+
+func (o *otelStatsD) WithPrefix(prefix string) tools.StatsD {
+	return tools.ScopeStatsD(o, prefix)
+}
+
+func (o *otelStatsD) WithTags(tags ...string) tools.StatsD {
+	return tools.ScopeStatsD(o, "", tags...)
+}
+
+func (o *otelStatsD) StartTimer(name string, tags ...string) *tools.Timer {
+	return tools.StartTimer(o, name, tags...)
+}
+
+func (o *otelStatsD) attributes(tags []string) metric.MeasurementOption {
+	return metric.WithAttributes(o.keyValues(tags)...)
+}
+
+func (o *otelStatsD) keyValues(tags []string) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(o.tags)+len(tags))
+	for _, tag := range append(append([]string{}, o.tags...), tags...) {
+		key, value, found := strings.Cut(tag, ":")
+		if !found {
+			value = otelTagWithoutValue
+		}
+		kvs = append(kvs, attribute.String(key, value))
+	}
+	return kvs
+}
+
+func (o *otelStatsD) logError(msg string, err error) {
+	if o.log != nil {
+		o.log.Error(msg, err)
+	}
+}
+
+// warnDropped logs the first time a Decr or negative count of the counter name is dropped
+func (o *otelStatsD) warnDropped(name string) {
+	if _, dropped := o.dropped.LoadOrStore(name, true); dropped || o.log == nil {
+		return
+	}
+	o.log.Warn("Dropping Decr and negative counts of OpenTelemetry counter ", name,
+		" as counters can't go down. Pass it to WithUpDownCounters to record it with an up-down counter.")
+}
+
+// otelInstruments creates each instrument once and keeps it for reuse, along with whether it could be created, so
+// a failure is only logged once per name
+type otelInstruments[T any] struct {
+	mu     sync.Mutex
+	byName map[string]otelInstrument[T]
+	sd     *otelStatsD
+	create func(name string) (T, error)
+}
+
+type otelInstrument[T any] struct {
+	instrument T
+	ok         bool
+}
+
+func newOTelInstruments[T any](sd *otelStatsD, create func(name string) (T, error)) *otelInstruments[T] {
+	return &otelInstruments[T]{byName: make(map[string]otelInstrument[T]), sd: sd, create: create}
+}
+
+func (i *otelInstruments[T]) get(name string) (T, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if cached, ok := i.byName[name]; ok {
+		return cached.instrument, cached.ok
+	}
+	instrument, err := i.create(name)
+	if err != nil {
+		i.sd.logError("Failed to create OpenTelemetry instrument "+name+": ", err)
+	}
+	// The SDK returns a usable instrument along with errors such as an invalid name, so only go without one when
+	// there isn't one
+	cached := otelInstrument[T]{instrument, any(instrument) != nil}
+	i.byName[name] = cached
+	return cached.instrument, cached.ok
+}
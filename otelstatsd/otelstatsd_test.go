@@ -0,0 +1,218 @@
+package otelstatsd
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tools "github.com/mergermarket/gotools"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// countingLogger counts the errors and warnings logged
+type countingLogger struct {
+	tools.MockLogger
+	errors   int
+	warnings int
+}
+
+func (l *countingLogger) Error(args ...interface{}) {
+	l.errors++
+	l.MockLogger.Error(args...)
+}
+
+func (l *countingLogger) Warn(args ...interface{}) {
+	l.warnings++
+	l.MockLogger.Warn(args...)
+}
+
+func newTestOTelStatsD(t *testing.T, opts ...tools.StatsDOption) (tools.StatsD, func() map[string]metricdata.Metrics) {
+	return newTestOTelStatsDWithLogger(t, nil, opts...)
+}
+
+func newTestOTelStatsDWithLogger(t *testing.T, logger tools.Logger, opts ...tools.StatsDOption) (tools.StatsD, func() map[string]metricdata.Metrics) {
+	return newTestOTelStatsDWithOptions(t, tools.NewStatsDConfig(true, logger, opts...))
+}
+
+func newTestOTelStatsDWithOptions(t *testing.T, config tools.StatsDConfig, opts ...Option) (tools.StatsD, func() map[string]metricdata.Metrics) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	sd := New(provider.Meter("test"), config, opts...)
+
+	collect := func() map[string]metricdata.Metrics {
+		var rm metricdata.ResourceMetrics
+		if err := reader.Collect(context.Background(), &rm); err != nil {
+			t.Fatal("failed to collect metrics ", err)
+		}
+		metrics := make(map[string]metricdata.Metrics)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				metrics[m.Name] = m
+			}
+		}
+		return metrics
+	}
+	return sd, collect
+}
+
+func TestOTelStatsD(t *testing.T) {
+
+	t.Run("should record counters with tags as attributes", func(t *testing.T) {
+		sd, collect := newTestOTelStatsD(t, tools.WithGlobalTags("region:eu"))
+
+		sd.Incr("web.response_code.all", "route:/hello", "flagged")
+		sd.Count("web.response_code.all", 2, "route:/hello", "flagged")
+
+		sum := collect()["app.web.response_code.all"].Data.(metricdata.Sum[int64])
+		assert.True(t, sum.IsMonotonic)
+		assert.Len(t, sum.DataPoints, 1)
+		assert.Equal(t, int64(3), sum.DataPoints[0].Value)
+		assert.Equal(t, attribute.NewSet(
+			attribute.String("region", "eu"),
+			attribute.String("route", "/hello"),
+			attribute.String("flagged", "true"),
+		), sum.DataPoints[0].Attributes)
+	})
+
+	t.Run("should record up-down counters", func(t *testing.T) {
+		sd, collect := newTestOTelStatsDWithOptions(t, tools.NewStatsDConfig(true, nil), WithUpDownCounters("requests.in_flight"))
+
+		requests := sd.WithPrefix("requests.")
+		requests.Incr("in_flight")
+		requests.Incr("in_flight")
+		requests.Decr("in_flight")
+		requests.Count("in_flight", 3)
+		requests.Count("in_flight", -2)
+
+		sum := collect()["app.requests.in_flight"].Data.(metricdata.Sum[int64])
+		assert.False(t, sum.IsMonotonic)
+		assert.Equal(t, int64(2), sum.DataPoints[0].Value)
+	})
+
+	t.Run("should drop Decr and negative counts of other counters with one warning", func(t *testing.T) {
+		logger := &countingLogger{}
+		sd, collect := newTestOTelStatsDWithLogger(t, logger)
+
+		sd.Incr("connections")
+		sd.Decr("connections")
+		sd.Count("connections", -2)
+
+		sum := collect()["app.connections"].Data.(metricdata.Sum[int64])
+		assert.True(t, sum.IsMonotonic)
+		assert.Equal(t, int64(1), sum.DataPoints[0].Value)
+		assert.Equal(t, 1, logger.warnings)
+		assert.Contains(t, logger.LastCall().Args.Msg, "connections")
+	})
+
+	t.Run("should log an invalid name once and still record the metric", func(t *testing.T) {
+		logger := &countingLogger{}
+		sd, collect := newTestOTelStatsDWithLogger(t, logger, tools.WithNamespace(""))
+
+		sd.Incr("1st place")
+		sd.Incr("1st place")
+
+		assert.Equal(t, 1, logger.errors)
+		assert.Equal(t, int64(2), collect()["1st place"].Data.(metricdata.Sum[int64]).DataPoints[0].Value)
+	})
+
+	t.Run("should record histograms and timings", func(t *testing.T) {
+		sd, collect := newTestOTelStatsD(t, tools.WithNamespace("search."))
+
+		sd.Histogram("query_time_ms", 10)
+		sd.Distribution("query_time_ms", 30)
+		sd.Timing("refresh_time", 1500*time.Millisecond)
+
+		metrics := collect()
+		histogram := metrics["search.query_time_ms"].Data.(metricdata.Histogram[float64])
+		assert.Equal(t, uint64(2), histogram.DataPoints[0].Count)
+		assert.Equal(t, 40.0, histogram.DataPoints[0].Sum)
+		timing := metrics["search.refresh_time"]
+		assert.Equal(t, "ms", timing.Unit)
+		assert.Equal(t, 1500.0, timing.Data.(metricdata.Histogram[float64]).DataPoints[0].Sum)
+	})
+
+	t.Run("should record gauges, sets, events and service checks", func(t *testing.T) {
+		sd, collect := newTestOTelStatsD(t)
+
+		sd.Gauge("queue.depth", 4)
+		sd.Set("users", "a")
+		sd.Set("users", "b")
+		sd.Set("users", "a")
+		sd.Event(&tools.StatsDEvent{Title: "deployed"})
+		sd.ServiceCheck(&tools.StatsDServiceCheck{Name: "search.index", Status: tools.ServiceCheckWarning})
+
+		metrics := collect()
+		assert.Equal(t, 4.0, metrics["app.queue.depth"].Data.(metricdata.Gauge[float64]).DataPoints[0].Value)
+		assert.Equal(t, 2.0, metrics["app.users"].Data.(metricdata.Gauge[float64]).DataPoints[0].Value)
+		events := metrics["app.events"].Data.(metricdata.Sum[int64]).DataPoints[0]
+		assert.Equal(t, int64(1), events.Value)
+		alertType, _ := events.Attributes.Value("alert_type")
+		assert.Equal(t, "info", alertType.AsString())
+		check := metrics["app.service_check.status"].Data.(metricdata.Gauge[float64]).DataPoints[0]
+		assert.Equal(t, 1.0, check.Value)
+	})
+
+	t.Run("should work with the HTTP client", func(t *testing.T) {
+		sd, collect := newTestOTelStatsD(t)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer ts.Close()
+
+		resp, err := tools.NewHTTPClientWithStats(http.DefaultClient, sd).Get(ts.URL)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Contains(t, collect(), "app.http_client.response_time_ms")
+	})
+}
+
+func TestNewOTLP(t *testing.T) {
+	received := make(chan *colmetricpb.ExportMetricsServiceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &colmetricpb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- req
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	sd, err := NewOTLP(context.Background(), tools.NewStatsDConfig(true, nil),
+		WithExporterOptions(otlpmetrichttp.WithEndpointURL(collector.URL+"/v1/metrics")))
+	if err != nil {
+		t.Fatal("failed to create the OTLP StatsD ", err)
+	}
+	sd.Incr("important_action", "tag1:tag1value")
+
+	assert.NoError(t, sd.Flush())
+
+	select {
+	case req := <-received:
+		rm := req.ResourceMetrics[0]
+		var serviceName string
+		for _, attr := range rm.Resource.Attributes {
+			if attr.Key == "service.name" {
+				serviceName = attr.Value.GetStringValue()
+			}
+		}
+		assert.Equal(t, "a-service-has-no-name", serviceName)
+		assert.Equal(t, "app.important_action", rm.ScopeMetrics[0].Metrics[0].Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the collector didn't receive any metrics")
+	}
+	assert.NoError(t, sd.Close())
+}
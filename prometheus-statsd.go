@@ -0,0 +1,343 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	promCounter            = "counter"
+	promGauge              = "gauge"
+	promHistogram          = "histogram"
+	promContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	promEventsName         = "events_total"
+	promServiceCheckName   = "service_check_status"
+	promTagWithoutValue    = "true"
+	promLabelPrefixIfDigit = "_"
+)
+
+// promHistogramBuckets are the default upper bounds of the histogram buckets used by PrometheusStatsD. Our
+// histograms are mostly response times in milliseconds, so the buckets are too.
+var promHistogramBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+var (
+	promInvalidNameChars  = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	promInvalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	promLabelEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// PrometheusStatsD is a StatsD that keeps metrics in memory and serves them in the Prometheus text exposition
+// format, for platforms that scrape Prometheus instead of running a Datadog agent. Metric names have dots
+// replaced with underscores, and name:value tags become labels.
+//
+//   - Incr and Count are counters with a _total suffix. Prometheus counters can't go down, so Decr and negative
+//     counts are dropped. Use a Gauge for values that go up and down.
+//   - Gauge is a gauge.
+//   - Histogram, Distribution and Timing are histograms with millisecond buckets from 5ms to 10s, unless
+//     WithPromHistogramBuckets is given. Timing is in milliseconds.
+//   - Set is a gauge of the number of distinct values seen, so it should only be used with a few values.
+//   - Event counts events_total by alert_type and ServiceCheck sets service_check_status for each check.
+type PrometheusStatsD struct {
+	mu        sync.Mutex
+	namespace string
+	tags      []string
+	buckets   []float64
+	families  map[string]*promFamily
+}
+
+// PrometheusOption configures optional behaviour of NewPrometheusStatsD
+type PrometheusOption func(*PrometheusStatsD)
+
+// WithPromHistogramBuckets sets the upper bounds of the histogram buckets, e.g. for histograms that aren't in
+// milliseconds
+func WithPromHistogramBuckets(bounds ...float64) PrometheusOption {
+	return func(p *PrometheusStatsD) {
+		p.buckets = slices.Clone(bounds)
+		slices.Sort(p.buckets)
+	}
+}
+
+type promFamily struct {
+	kind   string
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	labels  string
+	value   float64
+	bounds  []float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+	set     map[string]struct{}
+}
+
+// NewPrometheusStatsD creates a PrometheusStatsD. The namespace and global tags are taken from config, like
+// NewStatsD, and the rest of config is ignored. Serve it on /internal/metrics for Prometheus to scrape:
+//
+//	statsd := tools.NewPrometheusStatsD(tools.NewStatsDConfig(true, logger))
+//	router.Handle("/internal/metrics", statsd)
+func NewPrometheusStatsD(config StatsDConfig, opts ...PrometheusOption) *PrometheusStatsD {
+	namespace := config.Namespace()
+	p := &PrometheusStatsD{
+		namespace: namespace,
+		tags:      append(globalTags(), config.globalTags...),
+		buckets:   promHistogramBuckets,
+		families:  make(map[string]*promFamily),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Histogram observes value in a histogram
+func (p *PrometheusStatsD) Histogram(name string, value float64, tags ...string) {
+	p.observe(name, value, tags)
+}
+
+// Gauge sets a gauge to value
+func (p *PrometheusStatsD) Gauge(name string, value float64, tags ...string) {
+	p.update(promGauge, p.metricName(name), tags, func(s *promSeries) { s.value = value })
+}
+
+// Incr adds one to a counter
+func (p *PrometheusStatsD) Incr(name string, tags ...string) {
+	p.Count(name, 1, tags...)
+}
+
+// Count adds value to a counter. Negative values are dropped, as counters can't go down.
+func (p *PrometheusStatsD) Count(name string, value int64, tags ...string) {
+	if value < 0 {
+		return
+	}
+	p.update(promCounter, p.metricName(name)+"_total", tags, func(s *promSeries) { s.value += float64(value) })
+}
+
+// Timing observes value in milliseconds in a histogram
+func (p *PrometheusStatsD) Timing(name string, value time.Duration, tags ...string) {
+	p.observe(name, durationInMs(value), tags)
+}
+
+// Distribution observes value in a histogram
+func (p *PrometheusStatsD) Distribution(name string, value float64, tags ...string) {
+	p.observe(name, value, tags)
+}
+
+// Set adds value to the distinct values counted by a gauge
+func (p *PrometheusStatsD) Set(name string, value string, tags ...string) {
+	p.update(promGauge, p.metricName(name), tags, func(s *promSeries) {
+		if s.set == nil {
+			s.set = make(map[string]struct{})
+		}
+		s.set[value] = struct{}{}
+		s.value = float64(len(s.set))
+	})
+}
+
+// Decr does nothing, as counters can't go down
+func (p *PrometheusStatsD) Decr(string, ...string) {}
+
+// Event counts an event by its alert type
+func (p *PrometheusStatsD) Event(event *StatsDEvent) {
+	alertType := event.AlertType
+	if alertType == "" {
+		alertType = EventAlertInfo
+	}
+	tags := append([]string{"alert_type:" + string(alertType)}, event.Tags...)
+	p.update(promCounter, p.metricName(promEventsName), tags, func(s *promSeries) { s.value++ })
+}
+
+// ServiceCheck sets the status of a check: 0 for OK, 1 for warning, 2 for critical and 3 for unknown
+func (p *PrometheusStatsD) ServiceCheck(check *StatsDServiceCheck) {
+	tags := append([]string{"check:" + check.Name}, check.Tags...)
+	p.update(promGauge, p.metricName(promServiceCheckName), tags, func(s *promSeries) { s.value = float64(check.Status) })
+}
+
+// Flush does nothing, as metrics are kept until they are scraped
+func (p *PrometheusStatsD) Flush() error {
+	return nil
+}
+
+// Close does nothing, as there is no connection to release
+func (p *PrometheusStatsD) Close() error {
+	return nil
+}
+
+// WithContext returns a StatsD that adds the tags carried by ctx to every metric
+func (p *PrometheusStatsD) WithContext(ctx context.Context) StatsD {
+	return withContext(p, ctx)
+}
+
+// WithPrefix returns a StatsD that adds prefix to the name of every metric, after the namespace
+func (p *PrometheusStatsD) WithPrefix(prefix string) StatsD {
+	return withPrefix(p, prefix)
+}
+
+// WithTags returns a StatsD that adds tags to every metric
+func (p *PrometheusStatsD) WithTags(tags ...string) StatsD {
+	return withTags(p, tags...)
+}
+
+func (p *PrometheusStatsD) StartTimer(name string, tags ...string) *Timer {
+	return StartTimer(p, name, tags...)
+}
+
+func (p *PrometheusStatsD) observe(name string, value float64, tags []string) {
+	p.update(promHistogram, p.metricName(name), tags, func(s *promSeries) {
+		if s.buckets == nil {
+			// The series keeps the bounds it was created with, so its counts always line up with them
+			s.bounds = p.buckets
+			s.buckets = make([]uint64, len(s.bounds))
+		}
+		for i, bound := range s.bounds {
+			if value <= bound {
+				s.buckets[i]++
+			}
+		}
+		s.sum += value
+		s.count++
+	})
+}
+
+func (p *PrometheusStatsD) update(kind, name string, tags []string, fn func(*promSeries)) {
+	labels := promLabels(append(append([]string{}, p.tags...), tags...))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	family, ok := p.families[name]
+	if !ok {
+		family = &promFamily{kind: kind, series: make(map[string]*promSeries)}
+		p.families[name] = family
+	}
+	if family.kind != kind {
+		// A name can only have one type in Prometheus, so whichever is recorded first wins
+		return
+	}
+	series, ok := family.series[labels]
+	if !ok {
+		series = &promSeries{labels: labels}
+		family.series[labels] = series
+	}
+	fn(series)
+}
+
+func (p *PrometheusStatsD) metricName(name string) string {
+	return promName(p.namespace + name)
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format
+func (p *PrometheusStatsD) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", promContentType)
+	fmt.Fprint(w, p.exposition())
+}
+
+func (p *PrometheusStatsD) exposition() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		family := p.families[name]
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, family.kind)
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			writePromSeries(&b, name, family.kind, family.series[key])
+		}
+	}
+	return b.String()
+}
+
+func writePromSeries(b *strings.Builder, name, kind string, s *promSeries) {
+	if kind != promHistogram {
+		fmt.Fprintf(b, "%s%s %s\n", name, promLabelSet(s.labels, ""), promFloat(s.value))
+		return
+	}
+	for i, bound := range s.bounds {
+		fmt.Fprintf(b, "%s_bucket%s %d\n", name, promLabelSet(s.labels, promFloat(bound)), s.buckets[i])
+	}
+	fmt.Fprintf(b, "%s_bucket%s %d\n", name, promLabelSet(s.labels, "+Inf"), s.count)
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, promLabelSet(s.labels, ""), promFloat(s.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, promLabelSet(s.labels, ""), s.count)
+}
+
+func promLabelSet(labels, le string) string {
+	if le != "" {
+		if labels != "" {
+			labels += ","
+		}
+		labels += `le="` + le + `"`
+	}
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// promLabels turns tags into a sorted, comma separated label list that also identifies the series. Tags
+// without a value become a label with the value "true", and later tags replace earlier ones with the same key.
+func promLabels(tags []string) string {
+	values := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value, found := strings.Cut(tag, ":")
+		if !found {
+			value = promTagWithoutValue
+		}
+		values[promLabelName(key)] = value
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labels := make([]string, len(keys))
+	for i, key := range keys {
+		labels[i] = key + `="` + promLabelEscaper.Replace(values[key]) + `"`
+	}
+	return strings.Join(labels, ",")
+}
+
+func promName(name string) string {
+	name = promInvalidNameChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = promLabelPrefixIfDigit + name
+	}
+	return name
+}
+
+func promLabelName(key string) string {
+	key = promInvalidLabelChars.ReplaceAllString(key, "_")
+	if key == "" || (key[0] >= '0' && key[0] <= '9') {
+		key = promLabelPrefixIfDigit + key
+	}
+	return key
+}
+
+func promFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,118 @@
+package tools
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, handler http.Handler) string {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/internal/metrics", nil))
+	assert.Equal(t, promContentType, rec.Header().Get("Content-Type"))
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestPrometheusStatsD(t *testing.T) {
+
+	t.Run("should expose counters and gauges with tags as labels", func(t *testing.T) {
+		p := NewPrometheusStatsD(NewStatsDConfig(true, nil, WithNamespace("search."), WithGlobalTags("region:eu")))
+
+		p.Incr("web.response_code.all", "route:/hello", "caller:my-caller")
+		p.Count("web.response_code.all", 2, "caller:my-caller", "route:/hello")
+		p.Decr("web.response_code.all", "route:/hello", "caller:my-caller")
+		p.Count("web.response_code.all", -2, "route:/other")
+		p.Gauge("queue.depth", 3.5, "queue:x", "flagged")
+
+		assert.Equal(t, `# TYPE search_queue_depth gauge
+search_queue_depth{component="a-service-has-no-name",env="local",flagged="true",queue="x",region="eu"} 3.5
+# TYPE search_web_response_code_all_total counter
+search_web_response_code_all_total{caller="my-caller",component="a-service-has-no-name",env="local",region="eu",route="/hello"} 3
+`, scrape(t, p))
+	})
+
+	t.Run("should expose histograms", func(t *testing.T) {
+		p := &PrometheusStatsD{namespace: "app.", buckets: promHistogramBuckets, families: make(map[string]*promFamily)}
+
+		p.Histogram("http_client.response_time_ms", 7, "method:GET")
+		p.Timing("http_client.response_time_ms", 200*time.Millisecond, "method:GET")
+		p.Distribution("http_client.response_time_ms", 20000, "method:GET")
+
+		assert.Equal(t, `# TYPE app_http_client_response_time_ms histogram
+app_http_client_response_time_ms_bucket{method="GET",le="5"} 0
+app_http_client_response_time_ms_bucket{method="GET",le="10"} 1
+app_http_client_response_time_ms_bucket{method="GET",le="25"} 1
+app_http_client_response_time_ms_bucket{method="GET",le="50"} 1
+app_http_client_response_time_ms_bucket{method="GET",le="100"} 1
+app_http_client_response_time_ms_bucket{method="GET",le="250"} 2
+app_http_client_response_time_ms_bucket{method="GET",le="500"} 2
+app_http_client_response_time_ms_bucket{method="GET",le="1000"} 2
+app_http_client_response_time_ms_bucket{method="GET",le="2500"} 2
+app_http_client_response_time_ms_bucket{method="GET",le="5000"} 2
+app_http_client_response_time_ms_bucket{method="GET",le="10000"} 2
+app_http_client_response_time_ms_bucket{method="GET",le="+Inf"} 3
+app_http_client_response_time_ms_sum{method="GET"} 20207
+app_http_client_response_time_ms_count{method="GET"} 3
+`, scrape(t, p))
+	})
+
+	t.Run("should use the histogram buckets it was created with", func(t *testing.T) {
+		p := NewPrometheusStatsD(NewStatsDConfig(true, nil), WithPromHistogramBuckets(1, 0.1))
+		p.tags = nil
+
+		p.Histogram("size_mb", 0.5)
+
+		assert.Equal(t, `# TYPE app_size_mb histogram
+app_size_mb_bucket{le="0.1"} 0
+app_size_mb_bucket{le="1"} 1
+app_size_mb_bucket{le="+Inf"} 1
+app_size_mb_sum 0.5
+app_size_mb_count 1
+`, scrape(t, p))
+	})
+
+	t.Run("should expose sets, events and service checks", func(t *testing.T) {
+		p := &PrometheusStatsD{namespace: "app.", families: make(map[string]*promFamily)}
+
+		p.Set("users", "a")
+		p.Set("users", "b")
+		p.Set("users", "a")
+		p.Event(&StatsDEvent{Title: "deployed", AlertType: EventAlertWarning})
+		p.Event(&StatsDEvent{Title: "deployed"})
+		p.ServiceCheck(&StatsDServiceCheck{Name: "search.index", Status: ServiceCheckCritical})
+
+		assert.Equal(t, `# TYPE app_events_total counter
+app_events_total{alert_type="info"} 1
+app_events_total{alert_type="warning"} 1
+# TYPE app_service_check_status gauge
+app_service_check_status{check="search.index"} 2
+# TYPE app_users gauge
+app_users 2
+`, scrape(t, p))
+	})
+
+	t.Run("should sanitise names and escape label values", func(t *testing.T) {
+		p := &PrometheusStatsD{families: make(map[string]*promFamily)}
+
+		p.Gauge("2xx-rate", 1, "bad-key:a\"b\\c")
+		p.Histogram("2xx-rate", 1)
+
+		assert.Equal(t, `# TYPE _2xx_rate gauge
+_2xx_rate{bad_key="a\"b\\c"} 1
+`, scrape(t, p))
+	})
+
+	t.Run("should work with the HTTP handler", func(t *testing.T) {
+		p := &PrometheusStatsD{namespace: "app.", families: make(map[string]*promFamily)}
+		handler := HTTPHandlerWithStats("route", &MockHandler{response: http.StatusOK}, &MockLogger{}, p)
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com", nil))
+
+		assert.Contains(t, scrape(t, p), `app_web_response_code_200_total{response="200",route="route"} 1`)
+	})
+}
@@ -0,0 +1,195 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of requests for each key with a token bucket
+type RateLimiter interface {
+	Allow(key string) RateLimitResult
+}
+
+// RateLimitResult is the outcome of a single RateLimiter.Allow call
+type RateLimitResult struct {
+	Allowed bool
+	// Limit is the bucket size, i.e. the most requests that can be made in a burst
+	Limit int
+	// Remaining is the number of requests that can still be made straight away
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request will be allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitKeyFunc picks the key a request is rate limited by
+type RateLimitKeyFunc func(r *http.Request) string
+
+// ErrRateLimited is returned when an outbound request is rejected by a RateLimiter
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+const (
+	badRateErrMsg          = "the rate should be greater than 0, got %f"
+	badBurstErrMsg         = "the burst should be greater than 0, got %d"
+	rateLimitSweepInterval = time.Minute
+	unknownRateLimitKey    = "unknown"
+)
+
+type tokenBucketLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	clock     clock
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter creates a RateLimiter that allows ratePerSecond requests per key on average, with bursts
+// of up to burst requests
+func NewRateLimiter(ratePerSecond float64, burst int) (RateLimiter, error) {
+	if ratePerSecond <= 0 {
+		return nil, fmt.Errorf(badRateErrMsg, ratePerSecond)
+	}
+	if burst <= 0 {
+		return nil, fmt.Errorf(badBurstErrMsg, burst)
+	}
+	return &tokenBucketLimiter{
+		rate:    ratePerSecond,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		clock:   &timeClock{},
+	}, nil
+}
+
+// Allow takes a token from the bucket for key if one is available
+func (l *tokenBucketLimiter) Allow(key string) RateLimitResult {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	result := RateLimitResult{Limit: int(l.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = l.durationFor(1 - b.tokens)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = l.durationFor(l.burst - b.tokens)
+	return result
+}
+
+func (l *tokenBucketLimiter) refill(b *tokenBucket, now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+		b.updated = now
+	}
+}
+
+func (l *tokenBucketLimiter) durationFor(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, as they behave exactly like a new bucket. This stops
+// keys such as client IPs from growing the map forever.
+func (l *tokenBucketLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimitByCaller keys requests by the calling component in the X-Component header
+func RateLimitByCaller(r *http.Request) string {
+	if caller := r.Header.Get("X-Component"); caller != "" {
+		return caller
+	}
+	return unknownRateLimitKey
+}
+
+// RateLimitByIP keys requests by client IP. The first X-Forwarded-For address is used when present, as our
+// services sit behind load balancers, so only use this where that header is set by trusted infrastructure.
+func RateLimitByIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitByHost keys outbound requests by the host they are sent to. It is the HTTP client's default.
+func RateLimitByHost(r *http.Request) string {
+	if r.URL == nil || r.URL.Host == "" {
+		return unknownRateLimitKey
+	}
+	return r.URL.Host
+}
+
+// RateLimitByCallee keys outbound requests by their http_callee tag, so callees that share a host behind a
+// gateway get a bucket each. Requests without the tag are keyed by host.
+func RateLimitByCallee(r *http.Request) string {
+	if callee, ok := TagsFromContext(r.Context()).Value("http_callee"); ok {
+		return callee
+	}
+	return RateLimitByHost(r)
+}
+
+// RateLimitHandler limits the rate of requests to handler for each key returned by keyFunc. Every response
+// gets RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, and requests over the limit get a
+// 429 with a Retry-After header. Requests to /internal/ paths are never limited.
+func RateLimitHandler(routeName string, limiter RateLimiter, keyFunc RateLimitKeyFunc, handler http.Handler, statsd StatsD) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isInternalPath(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		result := limiter.Allow(keyFunc(r))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		if !result.Allowed {
+			tags := withCallerTag([]string{"route:" + routeName, fmt.Sprintf("response:%d", http.StatusTooManyRequests)}, r)
+			statsd.Incr(WebRequestThrottledKey, tags...)
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
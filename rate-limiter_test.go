@@ -0,0 +1,175 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRateLimiter(t *testing.T, rate float64, burst int) (*tokenBucketLimiter, *fakeClock) {
+	limiter, err := NewRateLimiter(rate, burst)
+	if err != nil {
+		t.Fatalf("failed to create a rate limiter %v", err)
+	}
+	mc := newFakeClock(0)
+	l := limiter.(*tokenBucketLimiter)
+	l.clock = mc
+	return l, mc
+}
+
+func TestRateLimiter(t *testing.T) {
+
+	t.Run("should not create a rate limiter with a bad rate or burst", func(t *testing.T) {
+		_, err := NewRateLimiter(0, 1)
+		assert.Error(t, err)
+
+		_, err = NewRateLimiter(1, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("should allow a burst and then limit", func(t *testing.T) {
+		l, _ := newTestRateLimiter(t, 1, 2)
+
+		first := l.Allow("a")
+		second := l.Allow("a")
+		third := l.Allow("a")
+
+		assert.True(t, first.Allowed)
+		assert.Equal(t, 1, first.Remaining)
+		assert.True(t, second.Allowed)
+		assert.Equal(t, 0, second.Remaining)
+		assert.False(t, third.Allowed)
+		assert.Equal(t, 2, third.Limit)
+		assert.Equal(t, time.Second, third.RetryAfter)
+		assert.Equal(t, 2*time.Second, third.Reset)
+	})
+
+	t.Run("should refill tokens over time", func(t *testing.T) {
+		l, mc := newTestRateLimiter(t, 2, 1)
+
+		assert.True(t, l.Allow("a").Allowed)
+		assert.False(t, l.Allow("a").Allowed)
+
+		mc.Advance(500 * time.Millisecond)
+
+		assert.True(t, l.Allow("a").Allowed)
+	})
+
+	t.Run("should limit each key separately", func(t *testing.T) {
+		l, _ := newTestRateLimiter(t, 1, 1)
+
+		assert.True(t, l.Allow("a").Allowed)
+		assert.True(t, l.Allow("b").Allowed)
+		assert.False(t, l.Allow("a").Allowed)
+	})
+
+	t.Run("should forget buckets once they have refilled", func(t *testing.T) {
+		l, mc := newTestRateLimiter(t, 1, 1)
+		l.Allow("a")
+
+		mc.Advance(2 * rateLimitSweepInterval)
+		l.Allow("b")
+
+		assert.Len(t, l.buckets, 1)
+	})
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	assert.Equal(t, "unknown", RateLimitByCaller(req))
+	assert.Equal(t, "10.0.0.1", RateLimitByIP(req))
+
+	req.Header.Set("X-Component", "my-caller")
+	req.Header.Set("X-Forwarded-For", "192.168.0.1, 10.0.0.2")
+
+	assert.Equal(t, "my-caller", RateLimitByCaller(req))
+	assert.Equal(t, "192.168.0.1", RateLimitByIP(req))
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	l, _ := newTestRateLimiter(t, 1, 1)
+	msd := &MockStatsD{}
+	handler := RateLimitHandler("route", l, RateLimitByCaller, &MockHandler{response: http.StatusOK}, msd)
+	req := httptest.NewRequest("GET", "http://example.com/hello", nil)
+	req.Header.Set("X-Component", "my-caller")
+
+	allowed := httptest.NewRecorder()
+	handler.ServeHTTP(allowed, req)
+
+	assert.Equal(t, http.StatusOK, allowed.Code)
+	assert.Equal(t, "1", allowed.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", allowed.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", allowed.Header().Get("RateLimit-Reset"))
+	assert.Len(t, msd.Calls, 0)
+
+	limited := httptest.NewRecorder()
+	handler.ServeHTTP(limited, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, limited.Code)
+	assert.Equal(t, "1", limited.Header().Get("Retry-After"))
+	assert.Len(t, msd.Calls, 1)
+	assert.Equal(t, WebRequestThrottledKey, msd.Calls[0].Args.Name)
+	assert.Equal(t, []string{"route:route", "response:429", "caller:my-caller"}, msd.Calls[0].Args.Tags)
+
+	internal := httptest.NewRecorder()
+	handler.ServeHTTP(internal, httptest.NewRequest("GET", "http://example.com/internal/healthcheck", nil))
+
+	assert.Equal(t, http.StatusOK, internal.Code)
+}
+
+func TestHTTPClientWithStats_RateLimiter(t *testing.T) {
+	l, _ := newTestRateLimiter(t, 1, 1)
+	msd := &MockStatsD{}
+	wc := NewHTTPClientWithStats(http.DefaultClient, msd, WithRateLimiter(l))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	resp, err := wc.Get(ts.URL, "http_callee:my-remote-service")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	msd.Calls = nil
+
+	resp, err = wc.Get(ts.URL, "http_callee:my-remote-service")
+
+	assert.Nil(t, resp)
+	assert.Equal(t, ErrRateLimited, err)
+	assert.Len(t, msd.Calls, 1)
+	assert.Equal(t, HttpClientRateLimitedKey, msd.Calls[0].Args.Name)
+	assert.Equal(t, []string{"http_callee:my-remote-service", "method:GET", "http_host:" + ts.Listener.Addr().String()}, msd.Calls[0].Args.Tags)
+}
+
+func TestHTTPClientWithStats_RateLimitByCallee(t *testing.T) {
+	l, _ := newTestRateLimiter(t, 1, 1)
+	wc := NewHTTPClientWithStats(http.DefaultClient, &MockStatsD{}, WithRateLimiter(l), WithRateLimitKey(RateLimitByCallee))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	for _, callee := range []string{"search", "users"} {
+		resp, err := wc.Get(ts.URL, "http_callee:"+callee)
+		assert.NoError(t, err, callee)
+		resp.Body.Close()
+	}
+	_, err := wc.Get(ts.URL, "http_callee:search")
+	assert.Equal(t, ErrRateLimited, err)
+
+	req, _ := http.NewRequestWithContext(ContextWithTags(context.Background(), "http_callee:profiles"), http.MethodGet, ts.URL, nil)
+	resp, err := wc.Do(req)
+	assert.NoError(t, err, "the callee can be carried by the request context")
+	resp.Body.Close()
+}
+
+func TestRateLimitByHost(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://search.example.com/q", nil)
+	assert.Equal(t, "search.example.com", RateLimitByHost(r))
+	assert.Equal(t, "search.example.com", RateLimitByCallee(r), "requests without a callee should be keyed by host")
+}
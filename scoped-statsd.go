@@ -0,0 +1,130 @@
+package tools
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// scopedStatsD adds a prefix to the name and tags to every metric before sending it to statsd. Like the
+// namespace, the prefix isn't added to events or service checks.
+type scopedStatsD struct {
+	statsd StatsD
+	prefix string
+	tags   []string
+}
+
+// ScopeStatsD returns a StatsD that adds prefix to the name of every metric and tags to every metric, event and
+// service check before sending them to statsd. Tags passed with a metric replace any of tags with the same key. It
+// is what WithPrefix, WithTags and WithContext return, for implementations of StatsD outside this package.
+func ScopeStatsD(statsd StatsD, prefix string, tags ...string) StatsD {
+	return &scopedStatsD{statsd: statsd, prefix: prefix, tags: slices.Clone(tags)}
+}
+
+// withPrefix is the WithPrefix of every StatsD
+func withPrefix(statsd StatsD, prefix string) StatsD {
+	return ScopeStatsD(statsd, prefix)
+}
+
+// withTags is the WithTags of every StatsD
+func withTags(statsd StatsD, tags ...string) StatsD {
+	return ScopeStatsD(statsd, "", tags...)
+}
+
+// withContext is the WithContext of every StatsD. It returns statsd itself when ctx doesn't carry any tags.
+func withContext(statsd StatsD, ctx context.Context) StatsD {
+	tags := TagsFromContext(ctx)
+	if len(tags) == 0 {
+		return statsd
+	}
+	return withTags(statsd, tags...)
+}
+
+func (s *scopedStatsD) Histogram(name string, value float64, tags ...string) {
+	s.statsd.Histogram(s.prefix+name, value, s.allTags(tags)...)
+}
+
+func (s *scopedStatsD) Gauge(name string, value float64, tags ...string) {
+	s.statsd.Gauge(s.prefix+name, value, s.allTags(tags)...)
+}
+
+func (s *scopedStatsD) Incr(name string, tags ...string) {
+	s.statsd.Incr(s.prefix+name, s.allTags(tags)...)
+}
+
+func (s *scopedStatsD) Count(name string, value int64, tags ...string) {
+	s.statsd.Count(s.prefix+name, value, s.allTags(tags)...)
+}
+
+func (s *scopedStatsD) Timing(name string, value time.Duration, tags ...string) {
+	s.statsd.Timing(s.prefix+name, value, s.allTags(tags)...)
+}
+
+func (s *scopedStatsD) Distribution(name string, value float64, tags ...string) {
+	s.statsd.Distribution(s.prefix+name, value, s.allTags(tags)...)
+}
+
+func (s *scopedStatsD) Set(name string, value string, tags ...string) {
+	s.statsd.Set(s.prefix+name, value, s.allTags(tags)...)
+}
+
+func (s *scopedStatsD) Decr(name string, tags ...string) {
+	s.statsd.Decr(s.prefix+name, s.allTags(tags)...)
+}
+
+func (s *scopedStatsD) Event(event *StatsDEvent) {
+	e := *event
+	e.Tags = s.allTags(e.Tags)
+	s.statsd.Event(&e)
+}
+
+func (s *scopedStatsD) ServiceCheck(check *StatsDServiceCheck) {
+	sc := *check
+	sc.Tags = s.allTags(sc.Tags)
+	s.statsd.ServiceCheck(&sc)
+}
+
+func (s *scopedStatsD) errorCounts() (sent, failed int64, ok bool) {
+	return errorCountsOf(s.statsd)
+}
+
+// Flush flushes the StatsD this was derived from
+func (s *scopedStatsD) Flush() error {
+	return s.statsd.Flush()
+}
+
+// Close does nothing, as the StatsD this was derived from owns the connection and may still be in use. Close that
+// one instead.
+func (s *scopedStatsD) Close() error {
+	return nil
+}
+
+// WithContext merges the tags carried by ctx into the tags of this StatsD, replacing any with the same key, so
+// deriving from the same context twice doesn't repeat them
+func (s *scopedStatsD) WithContext(ctx context.Context) StatsD {
+	tags := TagsFromContext(ctx)
+	if len(tags) == 0 {
+		return s
+	}
+	return &scopedStatsD{statsd: s.statsd, prefix: s.prefix, tags: s.allTags(tags)}
+}
+
+// WithPrefix adds prefix after the prefix of this StatsD
+func (s *scopedStatsD) WithPrefix(prefix string) StatsD {
+	return &scopedStatsD{statsd: s.statsd, prefix: s.prefix + prefix, tags: s.tags}
+}
+
+// WithTags adds tags after the tags of this StatsD, replacing any with the same key
+func (s *scopedStatsD) WithTags(tags ...string) StatsD {
+	return &scopedStatsD{statsd: s.statsd, prefix: s.prefix, tags: s.allTags(tags)}
+}
+
+func (s *scopedStatsD) StartTimer(name string, tags ...string) *Timer {
+	return StartTimer(s, name, tags...)
+}
+
+// allTags merges tags into the tags of this StatsD by key, so a metric recorded with, e.g., its own route tag
+// isn't also tagged with the route from the context
+func (s *scopedStatsD) allTags(tags []string) []string {
+	return Tags(s.tags).merge(tags, keepTag)
+}
@@ -0,0 +1,125 @@
+package tools
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsDWithContext(t *testing.T) {
+
+	t.Run("should return the same StatsD when the context has no tags", func(t *testing.T) {
+		msd := &MockStatsD{}
+
+		assert.Same(t, msd, msd.WithContext(context.Background()))
+	})
+
+	t.Run("should add the context tags to every metric", func(t *testing.T) {
+		msd := &MockStatsD{}
+		ctx := ContextWithTags(context.Background(), "tenant:a")
+
+		sd := msd.WithContext(ctx)
+		sd.Incr("incr", "tag:b")
+		sd.Histogram("histogram", 1)
+		sd.Event(&StatsDEvent{Title: "deployed", Tags: []string{"version:1"}})
+		sd.ServiceCheck(&StatsDServiceCheck{Name: "search.up"})
+
+		assert.Equal(t, []string{"tenant:a", "tag:b"}, msd.Calls[0].Args.Tags)
+		assert.Equal(t, []string{"tenant:a"}, msd.Calls[1].Args.Tags)
+		assert.Equal(t, []string{"tenant:a", "version:1"}, msd.Calls[2].Args.Tags)
+		assert.Equal(t, []string{"tenant:a"}, msd.Calls[3].Args.Tags)
+	})
+
+	t.Run("should combine the tags of nested contexts", func(t *testing.T) {
+		msd := &MockStatsD{}
+		sd := msd.WithContext(ContextWithTags(context.Background(), "tenant:a"))
+
+		sd.WithContext(ContextWithTags(context.Background(), "route:/b")).Incr("incr")
+		sd.Incr("incr")
+
+		assert.Equal(t, []string{"tenant:a", "route:/b"}, msd.Calls[0].Args.Tags)
+		assert.Equal(t, []string{"tenant:a"}, msd.Calls[1].Args.Tags)
+	})
+
+	t.Run("should not repeat tags when derived from the same context twice", func(t *testing.T) {
+		msd := &MockStatsD{}
+		ctx := ContextWithTags(context.Background(), "tenant:a", "route:/a")
+
+		msd.WithContext(ctx).WithContext(ContextWithTags(ctx, "route:/b")).Incr("incr")
+
+		assert.Equal(t, []string{"tenant:a", "route:/b"}, msd.Calls[0].Args.Tags)
+	})
+
+	t.Run("should let tags passed with a metric replace context tags with the same key", func(t *testing.T) {
+		msd := &MockStatsD{}
+		ctx := ContextWithTags(context.Background(), "route:/", "tenant:a")
+
+		msd.WithContext(ctx).WithTags("route:/hello").Incr("incr", "tenant:b")
+
+		assert.Equal(t, []string{"route:/hello", "tenant:b"}, msd.Calls[0].Args.Tags)
+	})
+
+	t.Run("should flush but not close the original StatsD", func(t *testing.T) {
+		msd := &MockStatsD{}
+		sd := msd.WithContext(ContextWithTags(context.Background(), "tenant:a"))
+
+		assert.NoError(t, sd.Flush())
+		assert.NoError(t, sd.Close())
+
+		assert.Equal(t, 1, msd.Flushes())
+		assert.Equal(t, 0, msd.Closes())
+	})
+}
+
+func TestStatsDWithPrefixAndTags(t *testing.T) {
+
+	t.Run("should compose prefixes and tags", func(t *testing.T) {
+		msd := &MockStatsD{}
+		search := msd.WithPrefix("search.").WithTags("team:data")
+		index := search.WithPrefix("index.").WithTags("index:users")
+
+		index.Count("documents", 3, "shard:1")
+		search.Timing("query_time", 0)
+		search.Set("users", "a")
+
+		assert.Equal(t, Args{"search.index.documents", 3, []string{"team:data", "index:users", "shard:1"}}, msd.Calls[0].Args)
+		assert.Equal(t, Args{"search.query_time", 0, []string{"team:data"}}, msd.Calls[1].Args)
+		assert.Equal(t, Args{"search.users", 0, []string{"team:data"}}, msd.Calls[2].Args)
+		assert.Equal(t, []string{"a"}, msd.Texts("search.users"))
+	})
+
+	t.Run("should not prefix events or service checks", func(t *testing.T) {
+		msd := &MockStatsD{}
+		sd := msd.WithPrefix("search.").WithTags("team:data")
+
+		sd.Event(&StatsDEvent{Title: "Reindexed"})
+		sd.ServiceCheck(&StatsDServiceCheck{Name: "search.index"})
+
+		assert.Equal(t, Args{"Reindexed", 0, []string{"team:data"}}, msd.Calls[0].Args)
+		assert.Equal(t, Args{"search.index", 0, []string{"team:data"}}, msd.Calls[1].Args)
+	})
+
+	t.Run("should not change the tags passed in", func(t *testing.T) {
+		msd := &MockStatsD{}
+		tags := []string{"team:data"}
+		sd := msd.WithTags(tags...)
+		tags[0] = "team:other"
+
+		sd.Incr("incr")
+
+		assert.Equal(t, []string{"team:data"}, msd.Calls[0].Args.Tags)
+	})
+
+	t.Run("should add the prefix after the namespace", func(t *testing.T) {
+		server := NewDogStatsDServer(t)
+		sd, _ := NewStatsD(NewStatsDConfig(true, &MockLogger{}, WithAddress(server.Address())))
+		defer sd.Close()
+
+		sd.WithPrefix("search.").WithTags("index:users").Incr("queries")
+		assert.NoError(t, sd.Flush())
+
+		assert.True(t, server.WaitFor("app.search.queries", 5*time.Second, "index:users"))
+	})
+}
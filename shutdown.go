@@ -0,0 +1,50 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// GracefulShutdown stops server accepting new requests and waits for in-flight ones to finish until ctx is
+// done, then flushes and closes statsd so that metrics recorded during shutdown aren't lost. server may be
+// nil for short-lived programs, such as Lambdas, that only need their metrics sending before they exit.
+func GracefulShutdown(ctx context.Context, server *http.Server, statsd StatsD, logger Logger) error {
+	var errs []error
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("Failed to shut down the server cleanly: ", err)
+			errs = append(errs, err)
+		}
+	}
+	if err := statsd.Flush(); err != nil {
+		logger.Error("Failed to flush metrics: ", err)
+		errs = append(errs, err)
+	}
+	if err := statsd.Close(); err != nil {
+		logger.Error("Failed to close StatsD: ", err)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ShutdownOnSignal blocks until the process receives SIGINT or SIGTERM and then calls GracefulShutdown,
+// allowing it at most timeout to complete.
+//
+//	go server.ListenAndServe()
+//	if err := tools.ShutdownOnSignal(server, statsd, logger, 10*time.Second); err != nil {
+//		os.Exit(1)
+//	}
+func ShutdownOnSignal(server *http.Server, statsd StatsD, logger Logger, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	logger.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return GracefulShutdown(shutdownCtx, server, statsd, logger)
+}
@@ -0,0 +1,56 @@
+package tools
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// shutdownStatsD records the order Flush and Close are called in
+type shutdownStatsD struct {
+	MockStatsD
+	order []string
+}
+
+func (s *shutdownStatsD) Flush() error {
+	s.order = append(s.order, "Flush")
+	return s.MockStatsD.Flush()
+}
+
+func (s *shutdownStatsD) Close() error {
+	s.order = append(s.order, "Close")
+	return s.MockStatsD.Close()
+}
+
+func TestGracefulShutdown(t *testing.T) {
+
+	t.Run("should shut down the server then flush and close statsd", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("failed to listen ", err)
+		}
+		server := &http.Server{Handler: http.HandlerFunc(InternalHealthCheck)}
+		served := make(chan error)
+		go func() { served <- server.Serve(listener) }()
+		sd := &shutdownStatsD{}
+
+		err = GracefulShutdown(context.Background(), server, sd, &MockLogger{})
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.ErrServerClosed, <-served)
+		assert.Equal(t, []string{"Flush", "Close"}, sd.order)
+	})
+
+	t.Run("should flush and close statsd without a server", func(t *testing.T) {
+		msd := &MockStatsD{}
+
+		err := GracefulShutdown(context.Background(), nil, msd, &MockLogger{})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, msd.Flushes())
+		assert.Equal(t, 1, msd.Closes())
+	})
+}
@@ -0,0 +1,211 @@
+package tools
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultErrorReportInterval = time.Minute
+	asyncErrorMetricName       = "unknown"
+)
+
+// StatsDErrorHandler is called with the name of every metric that fails to send and the error. Metrics that
+// fail after being buffered are reported with the name "unknown". It must be safe for concurrent use.
+type StatsDErrorHandler func(name string, err error)
+
+// errorCounter is implemented by StatsDs that count the metrics that failed to send, and by wrappers that pass
+// the counts through from the StatsDs they wrap. ok is false when nothing underneath counts failures.
+type errorCounter interface {
+	errorCounts() (sent, failed int64, ok bool)
+}
+
+// statsDErrorReporter counts metrics that fail to send and logs a summary at most once per interval, so an
+// agent that is down doesn't flood the logs with an error for every metric. Failures that haven't been logged
+// yet are logged on a ticker, so a short burst is reported even if nothing fails after it.
+type statsDErrorReporter struct {
+	log      Logger
+	interval time.Duration
+	handler  StatsDErrorHandler
+	clock    clock
+
+	sent   atomic.Int64
+	failed atomic.Int64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu         sync.Mutex
+	lastReport time.Time
+	failures   map[string]int64
+	lastErr    error
+}
+
+func newStatsDErrorReporter(config StatsDConfig) *statsDErrorReporter {
+	interval := config.errorReportInterval
+	if interval == 0 {
+		interval = defaultErrorReportInterval
+	}
+	return &statsDErrorReporter{
+		log:      config.log,
+		interval: interval,
+		handler:  config.errorHandler,
+		clock:    &timeClock{},
+		stop:     make(chan struct{}),
+		failures: make(map[string]int64),
+	}
+}
+
+// start logs pending failures every interval until close is called
+func (r *statsDErrorReporter) start() {
+	go r.run()
+}
+
+func (r *statsDErrorReporter) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.reportPending()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// close stops the ticker and logs any failures that haven't been reported yet
+func (r *statsDErrorReporter) close() {
+	r.stopOnce.Do(func() { close(r.stop) })
+	r.flush()
+}
+
+// record counts a metric sent to the client, and reports err if it failed
+func (r *statsDErrorReporter) record(name string, err error) {
+	r.sent.Add(1)
+	if err != nil {
+		r.report(name, err)
+	}
+}
+
+// asyncError reports an error from sending buffered metrics. It is passed to the client as its error handler.
+func (r *statsDErrorReporter) asyncError(err error) {
+	r.report(asyncErrorMetricName, err)
+}
+
+func (r *statsDErrorReporter) report(name string, err error) {
+	r.failed.Add(1)
+	if r.handler != nil {
+		r.handler(name, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures[name]++
+	r.lastErr = err
+	if now := r.clock.Now(); now.Sub(r.lastReport) >= r.interval {
+		r.lastReport = now
+		r.logSummary()
+	}
+}
+
+// reportPending logs the failures that haven't been reported yet, if the last summary was at least an interval ago
+func (r *statsDErrorReporter) reportPending() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := r.clock.Now(); len(r.failures) > 0 && now.Sub(r.lastReport) >= r.interval {
+		r.lastReport = now
+		r.logSummary()
+	}
+}
+
+// flush logs any failures that haven't been reported yet
+func (r *statsDErrorReporter) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logSummary()
+}
+
+// logSummary logs the failures since the last summary and forgets them. It must be called with the lock held.
+func (r *statsDErrorReporter) logSummary() {
+	if len(r.failures) == 0 {
+		return
+	}
+	names := make([]string, 0, len(r.failures))
+	var total int64
+	for name, count := range r.failures {
+		names = append(names, name)
+		total += count
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if r.failures[names[i]] != r.failures[names[j]] {
+			return r.failures[names[i]] > r.failures[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	counts := make([]string, len(names))
+	for i, name := range names {
+		counts[i] = fmt.Sprintf("%s: %d", name, r.failures[name])
+	}
+
+	if r.log != nil {
+		r.log.Errorf("Failed to send %d StatsD metrics (%s), last error: %v. Failures are reported at most every %s",
+			total, strings.Join(counts, ", "), r.lastErr, r.interval)
+	}
+	r.failures = make(map[string]int64)
+	r.lastErr = nil
+}
+
+// counts returns the number of metrics sent and the number that failed
+func (r *statsDErrorReporter) counts() (sent, failed int64) {
+	return r.sent.Load(), r.failed.Load()
+}
+
+// StatsDHealthCheck is a health check handler that fails with a 503 when more than maxFailureRate, between 0
+// and 1, of the metrics sent since the previous check failed to send. statsd should come from NewStatsD, or wrap
+// one with WithPrefix, WithTags, NewCardinalityGuard or NewMultiStatsD; any other StatsD is always healthy.
+// Errors from sending buffered metrics are counted per batch, so the rate is an estimate.
+func StatsDHealthCheck(statsd StatsD, maxFailureRate float64) http.HandlerFunc {
+	var mu sync.Mutex
+	var lastSent, lastFailed int64
+	return func(w http.ResponseWriter, _ *http.Request) {
+		sent, failed, ok := errorCountsOf(statsd)
+		if !ok {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "Healthy")
+			return
+		}
+
+		mu.Lock()
+		sentSince, failedSince := sent-lastSent, failed-lastFailed
+		lastSent, lastFailed = sent, failed
+		mu.Unlock()
+
+		var rate float64
+		if sentSince > 0 {
+			rate = min(float64(failedSince)/float64(sentSince), 1)
+		} else if failedSince > 0 {
+			rate = 1
+		}
+		if rate > maxFailureRate {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Unhealthy: %.1f%% of StatsD metrics failed to send", rate*100)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Healthy: %.1f%% of StatsD metrics failed to send", rate*100)
+	}
+}
+
+// errorCountsOf returns the error counts of statsd, if it or a StatsD it wraps counts failures
+func errorCountsOf(statsd StatsD) (sent, failed int64, ok bool) {
+	if counter, isCounter := statsd.(errorCounter); isCounter {
+		return counter.errorCounts()
+	}
+	return 0, 0, false
+}
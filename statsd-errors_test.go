@@ -0,0 +1,192 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestErrorReporter(opts ...StatsDOption) (*statsDErrorReporter, *MockLogger, *fakeClock) {
+	logger := &MockLogger{}
+	r := newStatsDErrorReporter(NewStatsDConfig(true, logger, opts...))
+	mc := newFakeClock(0)
+	r.clock = mc
+	return r, logger, mc
+}
+
+func TestStatsDErrorReporter(t *testing.T) {
+	errSend := errors.New("connection refused")
+
+	t.Run("should log the first failure and summarise the rest once per interval", func(t *testing.T) {
+		r, logger, mc := newTestErrorReporter()
+
+		r.record("web.response_time", errSend)
+		assert.Len(t, logger.calls, 1)
+		assert.Equal(t, "Failed to send 1 StatsD metrics (web.response_time: 1), last error: connection refused. Failures are reported at most every 1m0s", logger.LastCall().Args.Msg)
+
+		for i := 0; i < 5; i++ {
+			r.record("web.response_time", errSend)
+			r.record("http_client.response_time_ms", errSend)
+		}
+		r.record("http_client.response_time_ms", errSend)
+		assert.Len(t, logger.calls, 1)
+
+		mc.Advance(time.Minute)
+		r.record("web.response_code.all", errSend)
+		assert.Len(t, logger.calls, 2)
+		assert.Equal(t, "Error", logger.LastCall().Method)
+		assert.Contains(t, logger.LastCall().Args.Msg, "Failed to send 12 StatsD metrics (http_client.response_time_ms: 6, web.response_time: 5, web.response_code.all: 1)")
+	})
+
+	t.Run("should use the configured interval", func(t *testing.T) {
+		r, logger, mc := newTestErrorReporter(WithErrorReportInterval(time.Second))
+
+		r.record("a", errSend)
+		mc.Advance(time.Second)
+		r.record("a", errSend)
+
+		assert.Len(t, logger.calls, 2)
+	})
+
+	t.Run("should log unreported failures when flushed", func(t *testing.T) {
+		r, logger, _ := newTestErrorReporter()
+		r.record("a", errSend)
+		r.record("b", errSend)
+
+		r.flush()
+		r.flush()
+
+		assert.Len(t, logger.calls, 2)
+		assert.Contains(t, logger.LastCall().Args.Msg, "(b: 1)")
+	})
+
+	t.Run("should log pending failures on a ticker", func(t *testing.T) {
+		r, logger, mc := newTestErrorReporter(WithErrorReportInterval(10 * time.Millisecond))
+		r.record("a", errSend)
+		r.record("b", errSend)
+		mc.Advance(10 * time.Millisecond)
+
+		r.start()
+		defer r.close()
+
+		assert.Eventually(t, func() bool {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return len(logger.calls) == 2
+		}, 5*time.Second, time.Millisecond)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		assert.Contains(t, logger.LastCall().Args.Msg, "(b: 1)")
+	})
+
+	t.Run("should call the error handler for every failure", func(t *testing.T) {
+		var mu sync.Mutex
+		var failed []string
+		r, _, _ := newTestErrorReporter(WithErrorHandler(func(name string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			failed = append(failed, name)
+		}))
+
+		r.record("a", nil)
+		r.record("b", errSend)
+		r.asyncError(errSend)
+
+		assert.Equal(t, []string{"b", asyncErrorMetricName}, failed)
+		sent, failures := r.counts()
+		assert.Equal(t, int64(2), sent)
+		assert.Equal(t, int64(2), failures)
+	})
+
+	t.Run("should not log without a logger", func(t *testing.T) {
+		r := newStatsDErrorReporter(NewStatsDConfig(true, nil))
+
+		assert.NotPanics(t, func() { r.record("a", errSend) })
+	})
+
+	t.Run("should report errors from sending buffered metrics", func(t *testing.T) {
+		failures := make(chan string, 10)
+		sd, err := NewStatsD(NewStatsDConfig(true, &MockLogger{},
+			WithUDS(filepath.Join(t.TempDir(), "missing.socket")),
+			WithErrorHandler(func(name string, _ error) { failures <- name }),
+		))
+		if err != nil {
+			t.Fatal("failed to create StatsD ", err)
+		}
+		defer sd.Close()
+
+		sd.Incr("queries")
+		_ = sd.Flush()
+
+		select {
+		case name := <-failures:
+			assert.Equal(t, asyncErrorMetricName, name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the error handler wasn't called")
+		}
+	})
+}
+
+func TestStatsDHealthCheck(t *testing.T) {
+	check := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/internal/healthcheck", nil))
+		return w
+	}
+
+	t.Run("should be healthy while few metrics fail", func(t *testing.T) {
+		sd := &mmStatsD{errors: newStatsDErrorReporter(NewStatsDConfig(true, nil))}
+		handler := StatsDHealthCheck(sd, 0.5)
+		sd.errors.record("a", nil)
+		sd.errors.record("a", errors.New("failed"))
+
+		w := check(handler)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Healthy: 50.0% of StatsD metrics failed to send", w.Body.String())
+	})
+
+	t.Run("should be unhealthy when too many metrics fail since the last check", func(t *testing.T) {
+		sd := &mmStatsD{errors: newStatsDErrorReporter(NewStatsDConfig(true, nil))}
+		handler := StatsDHealthCheck(sd, 0.5)
+		sd.errors.record("a", nil)
+		check(handler)
+		sd.errors.record("a", errors.New("failed"))
+
+		w := check(handler)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "Unhealthy: 100.0% of StatsD metrics failed to send", w.Body.String())
+		assert.Equal(t, http.StatusOK, check(handler).Code)
+	})
+
+	t.Run("should see through wrapped StatsDs", func(t *testing.T) {
+		sd := &mmStatsD{errors: newStatsDErrorReporter(NewStatsDConfig(true, nil))}
+		multi := NewMultiStatsD(&MockLogger{}, MultiStatsDBackend{Name: "datadog", StatsD: sd}, MultiStatsDBackend{Name: "mock", StatsD: &MockStatsD{}})
+		defer multi.Close()
+		wrapped := []StatsD{
+			sd.WithTags("a:b"),
+			sd.WithPrefix("search.").WithContext(ContextWithTags(context.Background(), "c:d")),
+			NewCardinalityGuard(sd, CardinalityGuardConfig{}),
+			multi,
+		}
+		for _, statsd := range wrapped {
+			handler := StatsDHealthCheck(statsd, 0.5)
+			sd.errors.record("a", errors.New("failed"))
+
+			assert.Equal(t, http.StatusServiceUnavailable, check(handler).Code)
+		}
+	})
+
+	t.Run("should always be healthy for other StatsDs", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, check(StatsDHealthCheck(&MockStatsD{}, 0)).Code)
+		assert.Equal(t, http.StatusOK, check(StatsDHealthCheck(NewMultiStatsD(&MockLogger{}, MultiStatsDBackend{Name: "mock", StatsD: &MockStatsD{}}), 0)).Code)
+	})
+}
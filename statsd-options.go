@@ -0,0 +1,116 @@
+package tools
+
+import "time"
+
+// StatsDOption changes a setting of a StatsDConfig
+type StatsDOption func(*StatsDConfig)
+
+// StatsDAggregation is how much aggregation the client does before sending metrics to the agent
+type StatsDAggregation int
+
+const (
+	// AggregationBasic aggregates gauges, counts and sets. This is the default.
+	AggregationBasic StatsDAggregation = iota
+	// AggregationNone sends every metric to the agent as it is recorded
+	AggregationNone
+	// AggregationExtended also aggregates histograms, distributions and timings. It needs agent 6.25+ or 7.25+.
+	AggregationExtended
+)
+
+// DummyOutput is what the StatsD returned by NewStatsD outside production does with metrics
+type DummyOutput int
+
+const (
+	// DummyOutputInfo logs every metric at info level. This is the default.
+	DummyOutputInfo DummyOutput = iota
+	// DummyOutputDebug logs every metric at debug level
+	DummyOutputDebug
+	// DummyOutputDiscard drops every metric
+	DummyOutputDiscard
+	// DummyOutputSummary logs a table of the metrics recorded at info level once per summary interval. It logs
+	// from a goroutine that only stops when the StatsD is closed, so Close must be called.
+	DummyOutputSummary
+)
+
+// WithAddress sends metrics to the agent at address, in host:port form, instead of STATSD_HOST and STATSD_PORT
+func WithAddress(address string) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.address = address
+	}
+}
+
+// WithUDS sends metrics to the agent over the Unix domain socket at socketPath
+func WithUDS(socketPath string) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.address = "unix://" + socketPath
+	}
+}
+
+// WithNamespace prefixes every metric name with namespace instead of "app.". An empty namespace leaves metric
+// names unprefixed.
+func WithNamespace(namespace string) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.namespace = namespace
+		c.namespaceSet = true
+	}
+}
+
+// WithGlobalTags adds tags to every metric, alongside the env and component tags
+func WithGlobalTags(tags ...string) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.globalTags = append(c.globalTags, tags...)
+	}
+}
+
+// WithAggregation sets how much client-side aggregation is done
+func WithAggregation(aggregation StatsDAggregation) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.aggregation = aggregation
+	}
+}
+
+// WithDefaultSampleRate samples counters, histograms, timings and distributions at rate, between 0 and 1,
+// instead of sending all of them. Gauges and sets are never sampled, as each value replaces the last.
+func WithDefaultSampleRate(rate float64) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.sampleRate = rate
+	}
+}
+
+// WithBufferPoolSize sets the number of buffers used to batch metrics before they are sent
+func WithBufferPoolSize(size int) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.bufferPoolSize = size
+	}
+}
+
+// WithErrorReportInterval sets how often failures to send metrics are logged, instead of once a minute. The
+// failures in between are counted and logged together, so an agent that is down doesn't flood the logs.
+func WithErrorReportInterval(interval time.Duration) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.errorReportInterval = interval
+	}
+}
+
+// WithErrorHandler calls handler with every metric that fails to send, e.g. to count failures in another
+// system. Failures are still logged.
+func WithErrorHandler(handler StatsDErrorHandler) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.errorHandler = handler
+	}
+}
+
+// WithDummyOutput sets what is done with metrics outside production, or when there is no agent address
+func WithDummyOutput(output DummyOutput) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.dummyOutput = output
+	}
+}
+
+// WithSummaryInterval sets how often the table of metrics is logged with DummyOutputSummary, instead of once a
+// minute
+func WithSummaryInterval(interval time.Duration) StatsDOption {
+	return func(c *StatsDConfig) {
+		c.summaryInterval = interval
+	}
+}
@@ -0,0 +1,108 @@
+package tools
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStatsDConfig_Options(t *testing.T) {
+
+	t.Run("should keep the environment defaults", func(t *testing.T) {
+		t.Setenv("STATSD_HOST", "statsd.local")
+		t.Setenv("STATSD_PORT", "8125")
+
+		config := NewStatsDConfig(true, &MockLogger{})
+
+		assert.Equal(t, "statsd.local:8125", config.agentAddress())
+	})
+
+	t.Run("should apply options over the defaults", func(t *testing.T) {
+		t.Setenv("STATSD_HOST", "statsd.local")
+		t.Setenv("STATSD_PORT", "8125")
+
+		config := NewStatsDConfig(true, &MockLogger{},
+			WithAddress("localhost:9125"),
+			WithNamespace("search."),
+			WithGlobalTags("region:eu"),
+			WithGlobalTags("team:search"),
+			WithAggregation(AggregationExtended),
+			WithDefaultSampleRate(0.5),
+			WithBufferPoolSize(64),
+		)
+
+		assert.Equal(t, "localhost:9125", config.agentAddress())
+		assert.Equal(t, "search.", config.namespace)
+		assert.Equal(t, []string{"region:eu", "team:search"}, config.globalTags)
+		assert.Equal(t, AggregationExtended, config.aggregation)
+		assert.Equal(t, 0.5, config.sampleRate)
+		assert.Equal(t, 64, config.bufferPoolSize)
+	})
+
+	t.Run("should use a Unix domain socket address", func(t *testing.T) {
+		config := NewStatsDConfig(true, &MockLogger{}, WithUDS("/var/run/datadog/dsd.socket"))
+
+		assert.Equal(t, "unix:///var/run/datadog/dsd.socket", config.agentAddress())
+	})
+}
+
+func TestNewStatsD_Options(t *testing.T) {
+
+	t.Run("should pass the namespace and global tags to the client", func(t *testing.T) {
+		config := NewStatsDConfig(true, &MockLogger{}, WithAddress("localhost:8080"), WithNamespace("search."), WithGlobalTags("region:eu"))
+
+		sd, err := newMMStatsD(config)
+
+		assert.NoError(t, err)
+		client := reflect.ValueOf(sd.ddstatsd).Elem()
+		assert.Equal(t, "search.", client.FieldByName("namespace").String())
+		assert.True(t, contains(client.FieldByName("tags"), "region:eu"))
+		assert.True(t, contains(client.FieldByName("tags"), "env:local"))
+	})
+
+	t.Run("should use the default sample rate", func(t *testing.T) {
+		config := NewStatsDConfig(true, &MockLogger{}, WithAddress("localhost:8080"), WithDefaultSampleRate(0.25))
+
+		sd, err := newMMStatsD(config)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 0.25, sd.sampleRate)
+	})
+
+	t.Run("should not prefix metric names with an empty namespace", func(t *testing.T) {
+		config := NewStatsDConfig(true, &MockLogger{}, WithAddress("localhost:8080"), WithNamespace(""))
+
+		sd, err := newMMStatsD(config)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "", reflect.ValueOf(sd.ddstatsd).Elem().FieldByName("namespace").String())
+	})
+
+	t.Run("should not sample gauges or sets", func(t *testing.T) {
+		server := NewDogStatsDServer(t)
+		sd, err := NewStatsD(NewStatsDConfig(true, &MockLogger{}, WithAddress(server.Address()),
+			WithAggregation(AggregationNone), WithDefaultSampleRate(0.000001)))
+		if err != nil {
+			t.Fatal("failed to create StatsD ", err)
+		}
+		defer sd.Close()
+
+		sd.Gauge("queue_size", 3)
+		sd.Set("users", "user-1")
+		assert.NoError(t, sd.Flush())
+
+		assert.True(t, server.WaitFor("app.queue_size", 5*time.Second))
+		assert.True(t, server.WaitFor("app.users", 5*time.Second))
+		assert.Equal(t, 1.0, server.MetricsNamed("app.queue_size")[0].SampleRate)
+	})
+
+	t.Run("should reject a sample rate over 1", func(t *testing.T) {
+		config := NewStatsDConfig(true, &MockLogger{}, WithAddress("localhost:8080"), WithDefaultSampleRate(2))
+
+		_, err := NewStatsD(config)
+
+		assert.Error(t, err)
+	})
+}
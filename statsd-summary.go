@@ -0,0 +1,231 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultSummaryInterval = time.Minute
+	summaryCount           = "count"
+	summaryGauge           = "gauge"
+	summaryHistogram       = "histogram"
+	summarySet             = "set"
+)
+
+// summaryStatsD is the dummyStatsD for DummyOutputSummary. It aggregates metrics in memory and logs them as a
+// table once per interval, which is easier to read than a line per metric when running locally.
+type summaryStatsD struct {
+	log      Logger
+	interval time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.Mutex
+	start  time.Time
+	series map[string]*summarySeries
+}
+
+type summarySeries struct {
+	kind   string
+	name   string
+	tags   string
+	count  int64
+	value  float64
+	values []float64
+	set    map[string]struct{}
+}
+
+func newSummaryStatsD(config StatsDConfig) *summaryStatsD {
+	interval := config.summaryInterval
+	if interval == 0 {
+		interval = defaultSummaryInterval
+	}
+	s := &summaryStatsD{
+		log:      config.log,
+		interval: interval,
+		stop:     make(chan struct{}),
+		start:    time.Now(),
+		series:   make(map[string]*summarySeries),
+	}
+	go s.run()
+	return s
+}
+
+func (s *summaryStatsD) Histogram(name string, value float64, tags ...string) {
+	s.observe(name, value, tags)
+}
+
+func (s *summaryStatsD) Gauge(name string, value float64, tags ...string) {
+	s.update(summaryGauge, name, tags, func(series *summarySeries) { series.value = value })
+}
+
+func (s *summaryStatsD) Incr(name string, tags ...string) {
+	s.Count(name, 1, tags...)
+}
+
+func (s *summaryStatsD) Count(name string, value int64, tags ...string) {
+	s.update(summaryCount, name, tags, func(series *summarySeries) { series.value += float64(value) })
+}
+
+func (s *summaryStatsD) Timing(name string, value time.Duration, tags ...string) {
+	s.observe(name, durationInMs(value), tags)
+}
+
+func (s *summaryStatsD) Distribution(name string, value float64, tags ...string) {
+	s.observe(name, value, tags)
+}
+
+func (s *summaryStatsD) Set(name string, value string, tags ...string) {
+	s.update(summarySet, name, tags, func(series *summarySeries) {
+		if series.set == nil {
+			series.set = make(map[string]struct{})
+		}
+		series.set[value] = struct{}{}
+		series.value = float64(len(series.set))
+	})
+}
+
+func (s *summaryStatsD) Decr(name string, tags ...string) {
+	s.Count(name, -1, tags...)
+}
+
+// Event is logged straight away, as events are rare and worth seeing as they happen
+func (s *summaryStatsD) Event(event *StatsDEvent) {
+	s.log.Info(fmt.Sprintf(dummyEventFmtString, event.Title, event.Text, event.AlertType, event.Tags))
+}
+
+// ServiceCheck is logged straight away, as service checks are rare and worth seeing as they happen
+func (s *summaryStatsD) ServiceCheck(check *StatsDServiceCheck) {
+	s.log.Info(fmt.Sprintf(dummyServiceCheckFmtString, check.Name, check.Status, check.Message, check.Tags))
+}
+
+// Flush logs the summary of the metrics recorded since the last one
+func (s *summaryStatsD) Flush() error {
+	s.logSummary()
+	return nil
+}
+
+// Close stops the goroutine that logs summaries, after logging one for any metrics that haven't been. It must be
+// called, or the goroutine runs for as long as the process does.
+func (s *summaryStatsD) Close() error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.logSummary()
+	})
+	return nil
+}
+
+func (s *summaryStatsD) WithContext(ctx context.Context) StatsD {
+	return withContext(s, ctx)
+}
+
+func (s *summaryStatsD) WithPrefix(prefix string) StatsD {
+	return withPrefix(s, prefix)
+}
+
+func (s *summaryStatsD) WithTags(tags ...string) StatsD {
+	return withTags(s, tags...)
+}
+
+func (s *summaryStatsD) StartTimer(name string, tags ...string) *Timer {
+	return StartTimer(s, name, tags...)
+}
+
+func (s *summaryStatsD) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.logSummary()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *summaryStatsD) observe(name string, value float64, tags []string) {
+	s.update(summaryHistogram, name, tags, func(series *summarySeries) { series.values = append(series.values, value) })
+}
+
+func (s *summaryStatsD) update(kind, name string, tags []string, fn func(*summarySeries)) {
+	sorted := slices.Clone(tags)
+	sort.Strings(sorted)
+	joined := strings.Join(sorted, ",")
+	key := kind + "|" + name + "|" + joined
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	series, ok := s.series[key]
+	if !ok {
+		series = &summarySeries{kind: kind, name: name, tags: joined}
+		s.series[key] = series
+	}
+	series.count++
+	fn(series)
+}
+
+func (s *summaryStatsD) logSummary() {
+	s.mu.Lock()
+	series := make([]*summarySeries, 0, len(s.series))
+	for _, ss := range s.series {
+		series = append(series, ss)
+	}
+	since := time.Since(s.start).Round(time.Second)
+	s.series = make(map[string]*summarySeries)
+	s.start = time.Now()
+	s.mu.Unlock()
+
+	if len(series) == 0 {
+		return
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		if series[i].kind != series[j].kind {
+			return series[i].kind < series[j].kind
+		}
+		return series[i].tags < series[j].tags
+	})
+	s.log.Info(summaryTable(series, since))
+}
+
+func summaryTable(series []*summarySeries, since time.Duration) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "StatsD summary for the last %s:\n", since)
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tTAGS\tCOUNT\tVALUE\tP50\tP95\tP99\tMAX")
+	for _, ss := range series {
+		if ss.kind != summaryHistogram {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t\t\t\t\n", ss.name, ss.kind, ss.tags, ss.count, promFloat(ss.value))
+			continue
+		}
+		values := slices.Clone(ss.values)
+		sort.Float64s(values)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t\t%s\t%s\t%s\t%s\n", ss.name, ss.kind, ss.tags, ss.count,
+			promFloat(percentile(values, 50)), promFloat(percentile(values, 95)), promFloat(percentile(values, 99)),
+			promFloat(values[len(values)-1]))
+	}
+	w.Flush()
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// percentile returns the nearest-rank percentile p of sorted, which must not be empty
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
@@ -0,0 +1,101 @@
+package tools
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncLogger is a MockLogger for the summaries logged in the background
+type syncLogger struct {
+	MockLogger
+	mu sync.Mutex
+}
+
+func (l *syncLogger) Info(args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.MockLogger.Info(args...)
+}
+
+func (l *syncLogger) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.calls)
+}
+
+func TestSummaryStatsD(t *testing.T) {
+
+	t.Run("should log a table of the metrics on flush", func(t *testing.T) {
+		logger := &MockLogger{}
+		sd, _ := NewStatsD(NewStatsDConfig(false, logger, WithDummyOutput(DummyOutputSummary)))
+		defer sd.Close()
+
+		sd.Incr("web.response_code.all", "route:/a", "response:200")
+		sd.Count("web.response_code.all", 2, "response:200", "route:/a")
+		sd.Incr("web.response_code.all", "route:/b")
+		sd.Gauge("queue.depth", 3)
+		sd.Gauge("queue.depth", 5)
+		sd.Set("users", "a")
+		sd.Set("users", "a")
+		sd.Set("users", "b")
+		for i := 1; i <= 100; i++ {
+			sd.Timing("web.response_time", time.Duration(i)*time.Millisecond, "route:/a")
+		}
+		assert.Nil(t, logger.LastCall())
+
+		assert.NoError(t, sd.Flush())
+
+		lines := strings.Split(logger.LastCall().Args.Msg, "\n")
+		assert.Equal(t, "Info", logger.LastCall().Method)
+		assert.Equal(t, "StatsD summary for the last 0s:", lines[0])
+		assert.Equal(t, []string{
+			"NAME                   TYPE       TAGS                   COUNT  VALUE  P50  P95  P99  MAX",
+			"queue.depth            gauge                             2      5",
+			"users                  set                               3      2",
+			"web.response_code.all  count      response:200,route:/a  2      3",
+			"web.response_code.all  count      route:/b               1      1",
+			"web.response_time      histogram  route:/a               100           50   95   99   100",
+		}, lines[1:])
+	})
+
+	t.Run("should only summarise metrics since the last summary", func(t *testing.T) {
+		logger := &MockLogger{}
+		sd, _ := NewStatsD(NewStatsDConfig(false, logger, WithDummyOutput(DummyOutputSummary)))
+		defer sd.Close()
+		sd.Incr("a")
+		_ = sd.Flush()
+
+		_ = sd.Flush()
+
+		assert.Len(t, logger.calls, 1)
+	})
+
+	t.Run("should log a summary every interval and on close", func(t *testing.T) {
+		logger := &syncLogger{}
+		sd, _ := NewStatsD(NewStatsDConfig(false, logger, WithDummyOutput(DummyOutputSummary), WithSummaryInterval(10*time.Millisecond)))
+
+		sd.Incr("a")
+		assert.Eventually(t, func() bool { return logger.count() == 1 }, time.Second, time.Millisecond)
+		sd.Incr("b")
+		assert.NoError(t, sd.Close())
+		assert.NoError(t, sd.Close())
+
+		assert.Equal(t, 2, logger.count())
+	})
+
+	t.Run("should log events and service checks straight away", func(t *testing.T) {
+		logger := &MockLogger{}
+		sd, _ := NewStatsD(NewStatsDConfig(false, logger, WithDummyOutput(DummyOutputSummary)))
+		defer sd.Close()
+
+		sd.Event(&StatsDEvent{Title: "deployed", Text: "v1.2"})
+		sd.ServiceCheck(&StatsDServiceCheck{Name: "search.up", Status: ServiceCheckOK})
+
+		assert.Len(t, logger.calls, 2)
+		assert.Equal(t, "Event: title: deployed, text: v1.2, alert type: , tags: []", logger.calls[0].Args.Msg)
+	})
+}
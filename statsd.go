@@ -1,8 +1,13 @@
 package tools
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"errors"
 	"github.com/DataDog/datadog-go/v5/statsd"
@@ -13,17 +18,41 @@ import (
 //revive:disable
 const (
 	statsdRate                      = 1
+	defaultNamespace                = "app."
+	defaultDogStatsDPort            = "8125"
+	udpAddressPrefix                = "udp://"
+	noStatsDAddressMsg              = "No StatsD address found in STATSD_HOST and STATSD_PORT, DD_DOGSTATSD_URL or DD_AGENT_HOST. Metrics will only be logged"
 	dummyFmtString1                 = "%s: name: %s, value: %f, tags: %v"
 	dummyFmtString2                 = "%s: name: %s, tags: %v"
 	dummyFmtString3                 = "%s: name: %s, value: %d, tags: %v"
+	dummyFmtString4                 = "%s: name: %s, value: %v, tags: %v"
+	dummyEventFmtString             = "Event: title: %s, text: %s, alert type: %s, tags: %v"
+	dummyServiceCheckFmtString      = "ServiceCheck: name: %s, status: %d, message: %s, tags: %v"
 	HttpClientResponseCodeAllKey    = "http_client.response_code.all"
 	HttpClientResponseTimeKey       = "http_client.response_time_ms"
 	HttpClientResponseErrorKey      = "http_client.response_error"
 	HttpClientResponseSuccessKey    = "http_client.response_success"
 	HttpClientResponseCodeFormatKey = "http_client.response_code.%d"
+	HttpClientLimitedKey            = "http_client.limited"
+	HttpClientRateLimitedKey        = "http_client.rate_limited"
+	HttpClientHedgeFiredKey         = "http_client.hedge_fired"
+	HttpClientHedgeWonKey           = "http_client.hedge_won"
+	HttpClientHedgeSkippedKey       = "http_client.hedge_skipped"
+	HttpClientCacheHitKey           = "http_client.cache_hit"
+	HttpClientCacheMissKey          = "http_client.cache_miss"
+	HttpClientCacheRevalidationKey  = "http_client.cache_revalidation"
 	WebResponseTimeKey              = "web.response_time"
 	WebResponseCodeFormatKey        = "web.response_code.%d"
 	WebResponseCodeAllKey           = "web.response_code.all"
+	WebRequestShedKey               = "web.request_shed"
+	WebRequestThrottledKey          = "web.request_throttled"
+	AdaptiveLimiterLimitKey         = "adaptive_limiter.limit"
+	InstrumentTimeFormatKey         = "%s.time_ms"
+	InstrumentSuccessFormatKey      = "%s.success"
+	InstrumentErrorFormatKey        = "%s.error"
+	CardinalityMetricsDroppedKey    = "statsd.metrics_dropped"
+	CardinalityTagsDroppedKey       = "statsd.tags_dropped"
+	CardinalityTagsRewrittenKey     = "statsd.tags_rewritten"
 )
 
 //revive:enable
@@ -35,120 +64,394 @@ type StatsD interface {
 	Gauge(name string, value float64, tags ...string)
 	Incr(name string, tags ...string)
 	Count(name string, value int64, tags ...string)
+	Timing(name string, value time.Duration, tags ...string)
+	Distribution(name string, value float64, tags ...string)
+	Set(name string, value string, tags ...string)
+	Decr(name string, tags ...string)
+	Event(event *StatsDEvent)
+	ServiceCheck(check *StatsDServiceCheck)
+	// Flush sends any buffered metrics straight away
+	Flush() error
+	// Close flushes any buffered metrics and releases the connection. Nothing can be sent after Close. StatsDs
+	// from WithContext, WithPrefix and WithTags share the connection of the one they came from, so closing them
+	// does nothing.
+	Close() error
+	// WithContext returns a StatsD that adds the tags carried by ctx, from ContextWithTags, to every metric
+	WithContext(ctx context.Context) StatsD
+	// WithPrefix returns a StatsD that adds prefix to the name of every metric, after the namespace. The prefix
+	// isn't added to events or service checks.
+	WithPrefix(prefix string) StatsD
+	// WithTags returns a StatsD that adds tags to every metric
+	WithTags(tags ...string) StatsD
+	// StartTimer starts timing an operation, recorded as a histogram in milliseconds. Call Stop or StopWithTags
+	// on the Timer once it completes.
+	StartTimer(name string, tags ...string) *Timer
 }
 
+// StatsDEvent is a DataDog event. It is an alias so that callers don't need to import datadog-go.
+type StatsDEvent = statsd.Event
+
+// StatsDServiceCheck is a DataDog service check. It is an alias so that callers don't need to import
+// datadog-go.
+type StatsDServiceCheck = statsd.ServiceCheck
+
+// ServiceCheckStatus is the status reported by a StatsDServiceCheck
+type ServiceCheckStatus = statsd.ServiceCheckStatus
+
+// EventAlertType is the alert type of a StatsDEvent
+type EventAlertType = statsd.EventAlertType
+
+// EventPriority is the priority of a StatsDEvent
+type EventPriority = statsd.EventPriority
+
+// Values for the fields of StatsDEvent and StatsDServiceCheck
+const (
+	ServiceCheckOK       = statsd.Ok
+	ServiceCheckWarning  = statsd.Warn
+	ServiceCheckCritical = statsd.Critical
+	ServiceCheckUnknown  = statsd.Unknown
+	EventAlertInfo       = statsd.Info
+	EventAlertError      = statsd.Error
+	EventAlertWarning    = statsd.Warning
+	EventAlertSuccess    = statsd.Success
+	EventPriorityNormal  = statsd.Normal
+	EventPriorityLow     = statsd.Low
+)
+
 // StatsDConfig provides configuration for metrics recording
 type StatsDConfig struct {
-	isProduction bool
-	log          Logger
-	host         string
-	port         string
+	isProduction   bool
+	log            Logger
+	host           string
+	port           string
+	address        string
+	namespace      string
+	namespaceSet   bool
+	globalTags     []string
+	aggregation    StatsDAggregation
+	sampleRate     float64
+	bufferPoolSize int
+
+	errorReportInterval time.Duration
+	errorHandler        StatsDErrorHandler
+
+	dummyOutput     DummyOutput
+	summaryInterval time.Duration
 }
 
-func NewStatsDConfig(isProduction bool, log Logger) StatsDConfig {
-	return StatsDConfig{
+// NewStatsDConfig creates a StatsDConfig for the agent at STATSD_HOST and STATSD_PORT. If those aren't set,
+// the standard Datadog variables are used: DD_DOGSTATSD_URL (udp://host:port or unix:///path/to/socket),
+// then DD_AGENT_HOST and DD_DOGSTATSD_PORT. Pass options to change any of the other settings.
+func NewStatsDConfig(isProduction bool, log Logger, opts ...StatsDOption) StatsDConfig {
+	config := StatsDConfig{
 		isProduction: isProduction,
 		log:          log,
 		host:         os.Getenv("STATSD_HOST"),
 		port:         os.Getenv("STATSD_PORT"),
 	}
+	if config.agentAddress() == "" {
+		config.address = datadogAgentAddress()
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
 }
 
-// NewStatsD provides a new StatsD metrics recorder
+// NewStatsD provides a new StatsD metrics recorder. Call Close when it is no longer needed, to send any buffered
+// metrics and stop the goroutines that the client and DummyOutputSummary run in the background.
 func NewStatsD(config StatsDConfig) (StatsD, error) {
-	if !config.isProduction || config.port == "" || config.host == "" {
-		return &dummyStatsD{config.log}, nil
+	if !config.isProduction {
+		return newDummyStatsD(config), nil
+	}
+	if config.agentAddress() == "" {
+		if config.log != nil {
+			config.log.Warn(noStatsDAddressMsg)
+		}
+		return newDummyStatsD(config), nil
 	}
-	return newMMStatsD(config)
+	sd, err := newMMStatsD(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.log != nil {
+		config.log.Infof("Sending metrics to DogStatsD over %s at %s", sd.ddstatsd.GetTransport(), config.agentAddress())
+	}
+	return sd, nil
 }
 
 func newMMStatsD(config StatsDConfig) (*mmStatsD, error) {
-	if config.port == "" || config.host == "" {
-		return nil, errors.New("Port and Host are required fields")
+	address := config.agentAddress()
+	if address == "" {
+		return nil, errors.New("An address, or Port and Host, are required fields")
+	}
+	sampleRate := config.sampleRate
+	if sampleRate == 0 {
+		sampleRate = statsdRate
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("the sample rate should be between 0 and 1, got %f", sampleRate)
 	}
 
-	sd, err := statsd.New(config.host+":"+config.port, withGlobalNamespace(), withGlobalTags())
+	errs := newStatsDErrorReporter(config)
+	sd, err := statsd.New(address, append(config.clientOptions(), statsd.WithErrorHandler(errs.asyncError))...)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &mmStatsD{sd, config.log}, nil
+	errs.start()
+	return &mmStatsD{sd, errs, sampleRate}, nil
 }
 
-func withGlobalNamespace() statsd.Option {
-	return statsd.WithNamespace("app.")
+func (config StatsDConfig) agentAddress() string {
+	if config.address != "" {
+		return config.address
+	}
+	if config.port == "" || config.host == "" {
+		return ""
+	}
+	return config.host + ":" + config.port
 }
 
-func withGlobalTags() statsd.Option {
-	return statsd.WithTags(globalTags())
+// datadogAgentAddress finds the agent address from the standard Datadog environment variables
+func datadogAgentAddress() string {
+	if agentURL := os.Getenv("DD_DOGSTATSD_URL"); agentURL != "" {
+		if strings.HasPrefix(agentURL, statsd.UnixAddressPrefix) {
+			return agentURL
+		}
+		return withDefaultPort(strings.TrimPrefix(agentURL, udpAddressPrefix), os.Getenv("DD_DOGSTATSD_PORT"))
+	}
+	if host := os.Getenv("DD_AGENT_HOST"); host != "" {
+		return withDefaultPort(host, os.Getenv("DD_DOGSTATSD_PORT"))
+	}
+	return ""
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if port == "" {
+		port = defaultDogStatsDPort
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (config StatsDConfig) clientOptions() []statsd.Option {
+	options := []statsd.Option{statsd.WithTags(append(globalTags(), config.globalTags...))}
+	if namespace := config.Namespace(); namespace != "" {
+		options = append(options, statsd.WithNamespace(namespace))
+	}
+	switch config.aggregation {
+	case AggregationNone:
+		options = append(options, statsd.WithoutClientSideAggregation())
+	case AggregationExtended:
+		options = append(options, statsd.WithExtendedClientSideAggregation())
+	}
+	if config.bufferPoolSize > 0 {
+		options = append(options, statsd.WithBufferPoolSize(config.bufferPoolSize))
+	}
+	return options
+}
+
+// Namespace is the prefix of every metric name, "app." unless WithNamespace was used
+func (config StatsDConfig) Namespace() string {
+	if config.namespaceSet {
+		return config.namespace
+	}
+	return defaultNamespace
+}
+
+// GlobalTags are the tags added to every metric with WithGlobalTags, without the env and component tags
+func (config StatsDConfig) GlobalTags() []string {
+	return slices.Clone(config.globalTags)
+}
+
+// Logger is the Logger that StatsDs created from config log to
+func (config StatsDConfig) Logger() Logger {
+	return config.log
 }
 
 func globalTags() []string {
 	return []string{
-		"env:" + getEnv(),
-		"component:" + getComponentName(),
+		"env:" + EnvName(),
+		"component:" + ComponentName(),
 	}
 }
 
 type mmStatsD struct {
-	ddstatsd *statsd.Client
-	log      Logger
+	ddstatsd   *statsd.Client
+	errors     *statsDErrorReporter
+	sampleRate float64
 }
 
-const statsDErrMsg = "Failed to send"
-const statsDErrFmt = "%s %s %v"
-
 func (mmsd *mmStatsD) Histogram(name string, value float64, tags ...string) {
-	if err := mmsd.ddstatsd.Histogram(name, value, tags, statsdRate); err != nil {
-		errMsg := fmt.Sprintf(statsDErrFmt, statsDErrMsg, name, err)
-		mmsd.log.Error(errMsg)
-	}
+	mmsd.errors.record(name, mmsd.ddstatsd.Histogram(name, value, tags, mmsd.sampleRate))
 }
 
 func (mmsd *mmStatsD) Gauge(name string, value float64, tags ...string) {
-	if err := mmsd.ddstatsd.Gauge(name, value, tags, statsdRate); err != nil {
-		errMsg := fmt.Sprintf(statsDErrFmt, statsDErrMsg, name, err)
-		mmsd.log.Error(errMsg)
-	}
+	mmsd.errors.record(name, mmsd.ddstatsd.Gauge(name, value, tags, statsdRate))
 }
 
 func (mmsd *mmStatsD) Incr(name string, tags ...string) {
-	if err := mmsd.ddstatsd.Incr(name, tags, statsdRate); err != nil {
-		errMsg := fmt.Sprintf(statsDErrFmt, statsDErrMsg, name, err)
-		mmsd.log.Error(errMsg)
-	}
+	mmsd.errors.record(name, mmsd.ddstatsd.Incr(name, tags, mmsd.sampleRate))
 }
 
 func (mmsd *mmStatsD) Count(name string, value int64, tags ...string) {
-	if err := mmsd.ddstatsd.Count(name, value, tags, statsdRate); err != nil {
-		errMsg := fmt.Sprintf(statsDErrFmt, statsDErrMsg, name, err)
-		mmsd.log.Error(errMsg)
-	}
+	mmsd.errors.record(name, mmsd.ddstatsd.Count(name, value, tags, mmsd.sampleRate))
+}
+
+func (mmsd *mmStatsD) Timing(name string, value time.Duration, tags ...string) {
+	mmsd.errors.record(name, mmsd.ddstatsd.Timing(name, value, tags, mmsd.sampleRate))
+}
+
+func (mmsd *mmStatsD) Distribution(name string, value float64, tags ...string) {
+	mmsd.errors.record(name, mmsd.ddstatsd.Distribution(name, value, tags, mmsd.sampleRate))
+}
+
+func (mmsd *mmStatsD) Set(name string, value string, tags ...string) {
+	mmsd.errors.record(name, mmsd.ddstatsd.Set(name, value, tags, statsdRate))
+}
+
+func (mmsd *mmStatsD) Decr(name string, tags ...string) {
+	mmsd.errors.record(name, mmsd.ddstatsd.Decr(name, tags, mmsd.sampleRate))
+}
+
+func (mmsd *mmStatsD) Event(event *StatsDEvent) {
+	mmsd.errors.record(event.Title, mmsd.ddstatsd.Event(event))
+}
+
+func (mmsd *mmStatsD) ServiceCheck(check *StatsDServiceCheck) {
+	mmsd.errors.record(check.Name, mmsd.ddstatsd.ServiceCheck(check))
+}
+
+func (mmsd *mmStatsD) Flush() error {
+	return mmsd.ddstatsd.Flush()
+}
+
+// Close closes the client, stops the error reporter and logs any send failures that haven't been reported yet
+func (mmsd *mmStatsD) Close() error {
+	err := mmsd.ddstatsd.Close()
+	mmsd.errors.close()
+	return err
+}
+
+func (mmsd *mmStatsD) errorCounts() (sent, failed int64, ok bool) {
+	sent, failed = mmsd.errors.counts()
+	return sent, failed, true
+}
+
+func (mmsd *mmStatsD) WithContext(ctx context.Context) StatsD {
+	return withContext(mmsd, ctx)
+}
+
+func (mmsd *mmStatsD) WithPrefix(prefix string) StatsD {
+	return withPrefix(mmsd, prefix)
+}
+
+func (mmsd *mmStatsD) WithTags(tags ...string) StatsD {
+	return withTags(mmsd, tags...)
+}
+
+func (mmsd *mmStatsD) StartTimer(name string, tags ...string) *Timer {
+	return StartTimer(mmsd, name, tags...)
 }
 
 // dummyStatsD is returned when StatsDConfig.isDevelopment is set to true. It
 // stubs out the DataDog methods and sends them to the supplied logger
 type dummyStatsD struct {
 	Logger
+	output DummyOutput
+}
+
+func newDummyStatsD(config StatsDConfig) StatsD {
+	if config.dummyOutput == DummyOutputSummary {
+		return newSummaryStatsD(config)
+	}
+	return &dummyStatsD{config.log, config.dummyOutput}
+}
+
+func (dsd dummyStatsD) log(msg string) {
+	switch dsd.output {
+	case DummyOutputDebug:
+		dsd.Debug(msg)
+	case DummyOutputDiscard:
+	default:
+		dsd.Info(msg)
+	}
 }
 
 func (dsd dummyStatsD) Histogram(name string, value float64, tags ...string) {
 	logString := fmt.Sprintf(dummyFmtString1, "Histogram", name, value, tags)
-	dsd.Info(logString)
+	dsd.log(logString)
 }
 
 func (dsd dummyStatsD) Gauge(name string, value float64, tags ...string) {
 	logString := fmt.Sprintf(dummyFmtString1, "Gauge", name, value, tags)
-	dsd.Info(logString)
+	dsd.log(logString)
 }
 
 func (dsd dummyStatsD) Incr(name string, tags ...string) {
 	logString := fmt.Sprintf(dummyFmtString2, "Increment", name, tags)
-	dsd.Info(logString)
+	dsd.log(logString)
 }
 
 func (dsd dummyStatsD) Count(name string, value int64, tags ...string) {
 	logString := fmt.Sprintf(dummyFmtString3, "Count", name, value, tags)
-	dsd.Info(logString)
+	dsd.log(logString)
+}
+
+func (dsd dummyStatsD) Timing(name string, value time.Duration, tags ...string) {
+	logString := fmt.Sprintf(dummyFmtString4, "Timing", name, value, tags)
+	dsd.log(logString)
+}
+
+func (dsd dummyStatsD) Distribution(name string, value float64, tags ...string) {
+	logString := fmt.Sprintf(dummyFmtString1, "Distribution", name, value, tags)
+	dsd.log(logString)
+}
+
+func (dsd dummyStatsD) Set(name string, value string, tags ...string) {
+	logString := fmt.Sprintf(dummyFmtString4, "Set", name, value, tags)
+	dsd.log(logString)
+}
+
+func (dsd dummyStatsD) Decr(name string, tags ...string) {
+	logString := fmt.Sprintf(dummyFmtString2, "Decrement", name, tags)
+	dsd.log(logString)
+}
+
+func (dsd dummyStatsD) Event(event *StatsDEvent) {
+	logString := fmt.Sprintf(dummyEventFmtString, event.Title, event.Text, event.AlertType, event.Tags)
+	dsd.log(logString)
+}
+
+func (dsd dummyStatsD) ServiceCheck(check *StatsDServiceCheck) {
+	logString := fmt.Sprintf(dummyServiceCheckFmtString, check.Name, check.Status, check.Message, check.Tags)
+	dsd.log(logString)
+}
+
+func (dsd dummyStatsD) Flush() error {
+	return nil
+}
+
+func (dsd dummyStatsD) Close() error {
+	return nil
+}
+
+func (dsd dummyStatsD) WithContext(ctx context.Context) StatsD {
+	return withContext(dsd, ctx)
+}
+
+func (dsd dummyStatsD) WithPrefix(prefix string) StatsD {
+	return withPrefix(dsd, prefix)
+}
+
+func (dsd dummyStatsD) WithTags(tags ...string) StatsD {
+	return withTags(dsd, tags...)
+}
+
+func (dsd dummyStatsD) StartTimer(name string, tags ...string) *Timer {
+	return StartTimer(dsd, name, tags...)
 }
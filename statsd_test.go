@@ -3,6 +3,9 @@ package tools
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewStatsD(t *testing.T) {
@@ -51,6 +54,62 @@ func TestGlobalTagging(t *testing.T) {
 	}
 }
 
+func TestDummyStatsD_LogsExtendedMetrics(t *testing.T) {
+	logger := &MockLogger{}
+	sd, _ := NewStatsD(NewStatsDConfig(false, logger))
+
+	sd.Timing("timing", 1500*time.Millisecond, "tag:a")
+	sd.Distribution("distribution", 1.5)
+	sd.Set("set", "user-1")
+	sd.Decr("decr")
+	sd.Event(&StatsDEvent{Title: "deployed", Text: "v1.2.3", AlertType: EventAlertInfo})
+	sd.ServiceCheck(&StatsDServiceCheck{Name: "search.up", Status: ServiceCheckCritical, Message: "down"})
+
+	assert.Equal(t, []LoggerCall{
+		{"Info", LoggerArgs{"Timing: name: timing, value: 1.5s, tags: [tag:a]"}},
+		{"Info", LoggerArgs{"Distribution: name: distribution, value: 1.500000, tags: []"}},
+		{"Info", LoggerArgs{"Set: name: set, value: user-1, tags: []"}},
+		{"Info", LoggerArgs{"Decrement: name: decr, tags: []"}},
+		{"Info", LoggerArgs{"Event: title: deployed, text: v1.2.3, alert type: info, tags: []"}},
+		{"Info", LoggerArgs{"ServiceCheck: name: search.up, status: 2, message: down, tags: []"}},
+	}, logger.calls)
+}
+
+func TestMMStatsD_SendsExtendedMetrics(t *testing.T) {
+	logger := &MockLogger{}
+	config := StatsDConfig{
+		isProduction: true,
+		log:          logger,
+		host:         "localhost",
+		port:         "8080",
+	}
+	sd, _ := newMMStatsD(config)
+
+	sd.Timing("timing", time.Second)
+	sd.Distribution("distribution", 1.5)
+	sd.Set("set", "user-1")
+	sd.Decr("decr")
+	sd.Event(&StatsDEvent{Title: "deployed"})
+	sd.ServiceCheck(&StatsDServiceCheck{Name: "search.up", Status: ServiceCheckOK})
+
+	assert.Nil(t, logger.LastCall(), "Expected no errors to be logged")
+}
+
+func TestMMStatsD_FlushAndClose(t *testing.T) {
+	config := StatsDConfig{
+		isProduction: true,
+		log:          &MockLogger{},
+		host:         "localhost",
+		port:         "8080",
+	}
+	sd, _ := newMMStatsD(config)
+	sd.Incr("incr")
+
+	assert.NoError(t, sd.Flush())
+	assert.NoError(t, sd.Close())
+	assert.True(t, sd.ddstatsd.IsClosed())
+}
+
 func contains(strings reflect.Value, target string) bool {
 	for i := 0; i < strings.Len(); i++ {
 		if strings.Index(i).String() == target {
@@ -59,3 +118,117 @@ func contains(strings reflect.Value, target string) bool {
 	}
 	return false
 }
+
+func TestNewStatsDConfig_DatadogEnvironment(t *testing.T) {
+	clearStatsDEnv := func(t *testing.T) {
+		for _, name := range []string{"STATSD_HOST", "STATSD_PORT", "DD_DOGSTATSD_URL", "DD_AGENT_HOST", "DD_DOGSTATSD_PORT"} {
+			t.Setenv(name, "")
+		}
+	}
+
+	t.Run("should prefer STATSD_HOST and STATSD_PORT", func(t *testing.T) {
+		clearStatsDEnv(t)
+		t.Setenv("STATSD_HOST", "statsd.local")
+		t.Setenv("STATSD_PORT", "9125")
+		t.Setenv("DD_AGENT_HOST", "agent.local")
+
+		assert.Equal(t, "statsd.local:9125", NewStatsDConfig(true, nil).agentAddress())
+	})
+
+	t.Run("should use a unix DD_DOGSTATSD_URL", func(t *testing.T) {
+		clearStatsDEnv(t)
+		t.Setenv("DD_DOGSTATSD_URL", "unix:///var/run/datadog/dsd.socket")
+		t.Setenv("DD_AGENT_HOST", "agent.local")
+
+		assert.Equal(t, "unix:///var/run/datadog/dsd.socket", NewStatsDConfig(true, nil).agentAddress())
+	})
+
+	t.Run("should use a udp DD_DOGSTATSD_URL", func(t *testing.T) {
+		clearStatsDEnv(t)
+		t.Setenv("DD_DOGSTATSD_URL", "udp://agent.local")
+
+		assert.Equal(t, "agent.local:8125", NewStatsDConfig(true, nil).agentAddress())
+	})
+
+	t.Run("should use DD_AGENT_HOST and DD_DOGSTATSD_PORT", func(t *testing.T) {
+		clearStatsDEnv(t)
+		t.Setenv("DD_AGENT_HOST", "agent.local")
+		t.Setenv("DD_DOGSTATSD_PORT", "9125")
+
+		assert.Equal(t, "agent.local:9125", NewStatsDConfig(true, nil).agentAddress())
+	})
+
+	t.Run("should default DD_DOGSTATSD_PORT", func(t *testing.T) {
+		clearStatsDEnv(t)
+		t.Setenv("DD_AGENT_HOST", "agent.local")
+
+		assert.Equal(t, "agent.local:8125", NewStatsDConfig(true, nil).agentAddress())
+	})
+}
+
+func TestNewStatsD_LogsTransport(t *testing.T) {
+
+	t.Run("should log the UDS transport", func(t *testing.T) {
+		logger := &MockLogger{}
+		config := NewStatsDConfig(true, logger, WithUDS(t.TempDir()+"/dsd.socket"))
+
+		sd, err := NewStatsD(config)
+
+		assert.NoError(t, err)
+		defer sd.Close()
+		assert.Equal(t, "Info", logger.LastCall().Method)
+		assert.Contains(t, logger.LastCall().Args.Msg, "Sending metrics to DogStatsD over uds at unix://")
+	})
+
+	t.Run("should log the UDP transport", func(t *testing.T) {
+		logger := &MockLogger{}
+		config := NewStatsDConfig(true, logger, WithAddress("localhost:8125"))
+
+		sd, err := NewStatsD(config)
+
+		assert.NoError(t, err)
+		defer sd.Close()
+		assert.Equal(t, "Sending metrics to DogStatsD over udp at localhost:8125", logger.LastCall().Args.Msg)
+	})
+
+	t.Run("should warn when falling back to logging metrics", func(t *testing.T) {
+		logger := &MockLogger{}
+		config := StatsDConfig{isProduction: true, log: logger}
+
+		sd, err := NewStatsD(config)
+
+		assert.NoError(t, err)
+		assert.IsType(t, &dummyStatsD{}, sd)
+		assert.Equal(t, "Warn", logger.LastCall().Method)
+		assert.Equal(t, noStatsDAddressMsg, logger.LastCall().Args.Msg)
+	})
+}
+
+func TestDummyStatsD_Output(t *testing.T) {
+
+	t.Run("should log metrics at debug level", func(t *testing.T) {
+		logger := &MockLogger{}
+		sd, _ := NewStatsD(NewStatsDConfig(false, logger, WithDummyOutput(DummyOutputDebug)))
+
+		sd.Incr("incr", "tag:a")
+
+		assert.Equal(t, &LoggerCall{"Debug", LoggerArgs{"Increment: name: incr, tags: [tag:a]"}}, logger.LastCall())
+	})
+
+	t.Run("should discard metrics", func(t *testing.T) {
+		logger := &MockLogger{}
+		sd, _ := NewStatsD(NewStatsDConfig(false, logger, WithDummyOutput(DummyOutputDiscard)))
+
+		sd.Incr("incr")
+		sd.Event(&StatsDEvent{Title: "deployed"})
+
+		assert.Nil(t, logger.LastCall())
+	})
+
+	t.Run("should summarise metrics", func(t *testing.T) {
+		sd, _ := NewStatsD(NewStatsDConfig(false, &MockLogger{}, WithDummyOutput(DummyOutputSummary)))
+		defer sd.Close()
+
+		assert.IsType(t, &summaryStatsD{}, sd)
+	})
+}
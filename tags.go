@@ -0,0 +1,94 @@
+package tools
+
+import (
+	"context"
+	"strings"
+)
+
+type tagsContextKey struct{}
+
+// Tags is a list of StatsD tags in key:value form. It can be passed straight to any StatsD method:
+//
+//	tags := tools.NewTags(tools.Tag("index", index), tools.Tag("method", r.Method))
+//	statsd.Incr("search.queries", tags...)
+type Tags []string
+
+// Tag creates a key:value tag that follows Datadog's rules. It is lowercased, characters other than letters,
+// digits, underscores, minuses, colons, periods and slashes are replaced with underscores, it is truncated to
+// 200 characters, and anything before the first letter of the key is removed. A tag with an empty key or value is
+// just the other one, like "flagged".
+func Tag(key, value string) string {
+	key = strings.TrimLeftFunc(key, func(r rune) bool { return r > 127 || !isASCIILetter(byte(r)) })
+	switch {
+	case value == "":
+		return truncate(replaceInvalid(strings.ToLower(key), isTagChar), maxTagLength)
+	case key == "":
+		return Tag(value, "")
+	}
+	return truncate(replaceInvalid(strings.ToLower(key+":"+value), isTagChar), maxTagLength)
+}
+
+// NewTags creates Tags from tags, which are sanitised like Tag and merged like Merge. Tags that don't start
+// with a letter are dropped.
+func NewTags(tags ...string) Tags {
+	return Tags(nil).Merge(tags...)
+}
+
+// With returns a copy of t with the tag key set to value, replacing any existing value for key
+func (t Tags) With(key, value string) Tags {
+	return t.Merge(Tag(key, value))
+}
+
+// Merge returns a copy of t with tags added. Later tags replace earlier ones with the same key, keeping the
+// position of the first one, so there is only ever one value for each key.
+func (t Tags) Merge(tags ...string) Tags {
+	return t.merge(tags, sanitizeTag)
+}
+
+// merge is Merge with clean applied to every tag instead of sanitizeTag. Tags it returns false for are dropped.
+func (t Tags) merge(tags []string, clean func(string) (string, bool)) Tags {
+	merged := make(Tags, 0, len(t)+len(tags))
+	index := make(map[string]int, len(t)+len(tags))
+	for _, tag := range append(append([]string{}, t...), tags...) {
+		tag, ok := clean(tag)
+		if !ok {
+			continue
+		}
+		key, _, _ := strings.Cut(tag, ":")
+		if i, ok := index[key]; ok {
+			merged[i] = tag
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, tag)
+	}
+	return merged
+}
+
+// Value returns the value of the tag key, and whether t has it
+func (t Tags) Value(key string) (string, bool) {
+	for _, tag := range t {
+		if k, value, _ := strings.Cut(tag, ":"); k == key {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// ContextWithTags returns a copy of ctx carrying tags, merged with any tags ctx already carries. Middleware
+// can use it so metrics recorded further down the call chain are tagged with, e.g., the route or caller. Like
+// tags passed straight to a StatsD, they aren't sanitised, so use Tag to build them from arbitrary values.
+func ContextWithTags(ctx context.Context, tags ...string) context.Context {
+	return context.WithValue(ctx, tagsContextKey{}, TagsFromContext(ctx).merge(tags, keepTag))
+}
+
+// keepTag is a clean function for merge that leaves tags as they are, only dropping empty ones
+func keepTag(tag string) (string, bool) {
+	return tag, tag != ""
+}
+
+// TagsFromContext returns the tags carried by ctx, or nil if there aren't any
+func TagsFromContext(ctx context.Context) Tags {
+	tags, _ := ctx.Value(tagsContextKey{}).(Tags)
+	return tags
+}
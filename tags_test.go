@@ -0,0 +1,69 @@
+package tools
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTag(t *testing.T) {
+	assert.Equal(t, "method:get", Tag("method", "GET"))
+	assert.Equal(t, "route:/users/_id_", Tag("route", "/users/{id}"))
+	assert.Equal(t, "caller:my_service", Tag("Caller", "My Service"))
+	assert.Equal(t, "index-name:a", Tag("1index-name", "a"))
+	assert.Equal(t, "index:a", Tag("_index", "a"))
+	assert.Equal(t, "flagged", Tag("flagged", ""))
+	assert.Equal(t, "flagged", Tag("", "Flagged"))
+	assert.Equal(t, "flagged", Tag("1", "flagged"))
+	assert.Equal(t, "", Tag("", ""))
+	assert.Len(t, Tag("query", strings.Repeat("q", 300)), 200)
+}
+
+func TestTags(t *testing.T) {
+
+	t.Run("should sanitise and deduplicate tags", func(t *testing.T) {
+		tags := NewTags("Route:/a", "method:get", "1bad", "route:/b", "flagged", "flagged")
+
+		assert.Equal(t, Tags{"route:/b", "method:get", "flagged"}, tags)
+	})
+
+	t.Run("should set tags without changing the original", func(t *testing.T) {
+		tags := NewTags("route:/a")
+
+		withMethod := tags.With("method", "POST").With("route", "/b")
+
+		assert.Equal(t, Tags{"route:/a"}, tags)
+		assert.Equal(t, Tags{"route:/b", "method:post"}, withMethod)
+		value, ok := withMethod.Value("method")
+		assert.True(t, ok)
+		assert.Equal(t, "post", value)
+		_, ok = withMethod.Value("caller")
+		assert.False(t, ok)
+	})
+
+	t.Run("should be passed to StatsD methods", func(t *testing.T) {
+		msd := &MockStatsD{}
+		tags := NewTags(Tag("index", "users"))
+
+		msd.Incr("search.queries", tags...)
+
+		msd.AssertCalled(t, "search.queries", "index:users")
+	})
+
+	t.Run("should carry tags in a context", func(t *testing.T) {
+		assert.Nil(t, TagsFromContext(context.Background()))
+
+		ctx := ContextWithTags(context.Background(), Tag("route", "/a"), Tag("caller", "web"))
+		ctx = ContextWithTags(ctx, Tag("route", "/b"))
+
+		assert.Equal(t, Tags{"route:/b", "caller:web"}, TagsFromContext(ctx))
+	})
+
+	t.Run("should carry tags in a context as they are", func(t *testing.T) {
+		ctx := ContextWithTags(context.Background(), "route:/Search/{index}", "")
+
+		assert.Equal(t, Tags{"route:/Search/{index}"}, TagsFromContext(ctx))
+	})
+}
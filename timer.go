@@ -0,0 +1,110 @@
+package tools
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// Timer records how long an operation took as a histogram in milliseconds
+type Timer struct {
+	statsd StatsD
+	clock  clock
+	name   string
+	tags   []string
+	start  time.Time
+}
+
+// StartTimer starts timing an operation on statsd. Call Stop or StopWithTags once it completes. It is what the
+// StartTimer method of every StatsD calls, so most code should call statsd.StartTimer instead.
+func StartTimer(statsd StatsD, name string, tags ...string) *Timer {
+	return startTimer(statsd, &timeClock{}, name, tags...)
+}
+
+func startTimer(statsd StatsD, clock clock, name string, tags ...string) *Timer {
+	return &Timer{
+		statsd: statsd,
+		clock:  clock,
+		name:   name,
+		tags:   slices.Clone(tags),
+		start:  clock.Now(),
+	}
+}
+
+// Stop records the time since the timer was started and returns it
+func (t *Timer) Stop() time.Duration {
+	return t.StopWithTags()
+}
+
+// StopWithTags records the time since the timer was started with extra tags, for details that are only known
+// once the operation has completed, such as a response code
+func (t *Timer) StopWithTags(tags ...string) time.Duration {
+	duration := t.clock.Now().Sub(t.start)
+	t.statsd.Histogram(t.name, durationInMs(duration), append(append([]string{}, t.tags...), tags...)...)
+	return duration
+}
+
+func durationInMs(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / 1000000
+}
+
+// Instrument calls fn and records how long it took in <name>.time_ms, then increments <name>.success or
+// <name>.error depending on the error it returns. Errors are tagged with an error_type. The error from fn is
+// returned unchanged.
+func Instrument(statsd StatsD, name string, fn func() error, tags ...string) error {
+	return instrument(statsd, &timeClock{}, name, fn, tags...)
+}
+
+func instrument(statsd StatsD, clock clock, name string, fn func() error, tags ...string) error {
+	timer := startTimer(statsd, clock, fmt.Sprintf(InstrumentTimeFormatKey, name), tags...)
+	err := fn()
+	timer.Stop()
+	if err != nil {
+		statsd.Incr(fmt.Sprintf(InstrumentErrorFormatKey, name), append(slices.Clip(tags), "error_type:"+errorType(err))...)
+	} else {
+		statsd.Incr(fmt.Sprintf(InstrumentSuccessFormatKey, name), tags...)
+	}
+	return err
+}
+
+// errorType classifies an error into a small, fixed set of values that are safe to use as a tag: timeout,
+// context_canceled, dns, connection_refused, reset, tls or other
+func errorType(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "context_canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case isTLSError(err):
+		return "tls"
+	default:
+		return "other"
+	}
+}
+
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
@@ -0,0 +1,104 @@
+package tools
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimer(t *testing.T) {
+
+	t.Run("should record the duration in milliseconds", func(t *testing.T) {
+		msd := &MockStatsD{}
+		timer := startTimer(msd, newFakeClock(100*time.Millisecond), "operation.time_ms", "tag:a")
+
+		duration := timer.Stop()
+
+		assert.Equal(t, 100*time.Millisecond, duration)
+		assert.Len(t, msd.Calls, 1)
+		assert.Equal(t, "Histogram", msd.Calls[0].Method)
+		assert.Equal(t, "operation.time_ms", msd.Calls[0].Args.Name)
+		assert.Equal(t, 100.0, msd.Calls[0].Args.Value)
+		assert.Equal(t, []string{"tag:a"}, msd.Calls[0].Args.Tags)
+	})
+
+	t.Run("should add tags when stopped", func(t *testing.T) {
+		msd := &MockStatsD{}
+		tags := []string{"tag:a"}
+		timer := startTimer(msd, newFakeClock(100*time.Millisecond), "operation.time_ms", tags...)
+
+		timer.StopWithTags("result:ok")
+
+		assert.Equal(t, []string{"tag:a", "result:ok"}, msd.Calls[0].Args.Tags)
+		assert.Equal(t, []string{"tag:a"}, tags)
+	})
+
+	t.Run("should be started from a StatsD", func(t *testing.T) {
+		msd := &MockStatsD{}
+
+		msd.WithPrefix("search.").StartTimer("query.time_ms", "index:x").Stop()
+
+		msd.AssertCalled(t, "search.query.time_ms", "index:x")
+	})
+}
+
+func TestInstrument(t *testing.T) {
+
+	t.Run("should record the duration and success", func(t *testing.T) {
+		msd := &MockStatsD{}
+
+		err := instrument(msd, newFakeClock(100*time.Millisecond), "search.query", func() error { return nil }, "index:x")
+
+		assert.NoError(t, err)
+		assert.Len(t, msd.Calls, 2)
+		assert.Equal(t, "Histogram", msd.Calls[0].Method)
+		assert.Equal(t, "search.query.time_ms", msd.Calls[0].Args.Name)
+		assert.Equal(t, 100.0, msd.Calls[0].Args.Value)
+		assert.Equal(t, "Incr", msd.Calls[1].Method)
+		assert.Equal(t, "search.query.success", msd.Calls[1].Args.Name)
+		assert.Equal(t, []string{"index:x"}, msd.Calls[1].Args.Tags)
+	})
+
+	t.Run("should record the duration and error type on failure", func(t *testing.T) {
+		msd := &MockStatsD{}
+		expected := fmt.Errorf("querying: %w", context.DeadlineExceeded)
+
+		err := Instrument(msd, "search.query", func() error { return expected }, "index:x")
+
+		assert.Equal(t, expected, err)
+		assert.Len(t, msd.Calls, 2)
+		assert.Equal(t, "search.query.time_ms", msd.Calls[0].Args.Name)
+		assert.Equal(t, []string{"index:x"}, msd.Calls[0].Args.Tags)
+		assert.Equal(t, "search.query.error", msd.Calls[1].Args.Name)
+		assert.Equal(t, []string{"index:x", "error_type:timeout"}, msd.Calls[1].Args.Tags)
+	})
+
+	t.Run("should not overwrite the caller's tags", func(t *testing.T) {
+		msd := &MockStatsD{}
+		tags := make([]string, 1, 2)
+		tags[0] = "index:x"
+		spare := tags[:2]
+
+		Instrument(msd, "search.query", func() error { return errors.New("boom") }, tags...)
+
+		assert.Equal(t, "", spare[1])
+	})
+}
+
+func TestErrorType(t *testing.T) {
+	assert.Equal(t, "context_canceled", errorType(context.Canceled))
+	assert.Equal(t, "timeout", errorType(context.DeadlineExceeded))
+	assert.Equal(t, "other", errorType(errors.New("boom")))
+	assert.Equal(t, "dns", errorType(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "x.invalid"}}))
+	assert.Equal(t, "connection_refused", errorType(&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}))
+	assert.Equal(t, "reset", errorType(&net.OpError{Op: "read", Err: syscall.ECONNRESET}))
+	assert.Equal(t, "tls", errorType(&url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}))
+}
@@ -0,0 +1,78 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type routeTemplateContextKey struct{}
+
+// ContextWithRouteTemplate returns a copy of ctx carrying the route template of an outbound request, like
+// "/users/{id}". HTTPClientWithStats tags the metrics of requests made with the context with
+// http_route:<template>, so requests to the same route are grouped without tagging every path.
+func ContextWithRouteTemplate(ctx context.Context, template string) context.Context {
+	return context.WithValue(ctx, routeTemplateContextKey{}, template)
+}
+
+// RouteTemplateFromContext returns the route template carried by ctx, or "" if there isn't one
+func RouteTemplateFromContext(ctx context.Context) string {
+	template, _ := ctx.Value(routeTemplateContextKey{}).(string)
+	return template
+}
+
+// GetTemplate gets the URL made by ExpandURLTemplate(urlTemplate, params...) with client, tagging the metrics with
+// the path of urlTemplate instead of the path requested, e.g.
+//
+//	GetTemplate(ctx, client, "https://api/users/{id}", []string{id}, "http_callee:users")
+//
+// It is a function rather than a method of HTTPClientWithStats so that other implementations of the interface,
+// such as mocks, don't have to add it.
+func GetTemplate(ctx context.Context, client HTTPClientWithStats, urlTemplate string, params []string, tags ...string) (*http.Response, error) {
+	ctx = ContextWithRouteTemplate(ctx, routeOfTemplate(urlTemplate))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ExpandURLTemplate(urlTemplate, params...), nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req, tags...)
+}
+
+// ExpandURLTemplate replaces each {name} placeholder in template with the next of params, escaped for use in
+// a path, or in a query after the first "?", so a param can't add path segments or query parameters.
+// Placeholders without a param are left as they are.
+func ExpandURLTemplate(template string, params ...string) string {
+	var b strings.Builder
+	rest := template
+	inQuery := false
+	for _, param := range params {
+		start := strings.Index(rest, "{")
+		end := strings.Index(rest, "}")
+		if start < 0 || end < start {
+			break
+		}
+		b.WriteString(rest[:start])
+		inQuery = inQuery || strings.Contains(rest[:start], "?")
+		if inQuery {
+			b.WriteString(url.QueryEscape(param))
+		} else {
+			b.WriteString(url.PathEscape(param))
+		}
+		rest = rest[end+1:]
+	}
+	b.WriteString(rest)
+	return b.String()
+}
+
+// routeOfTemplate returns the path of a URL template, without the scheme, host or query
+func routeOfTemplate(template string) string {
+	if _, afterScheme, ok := strings.Cut(template, "://"); ok {
+		if i := strings.Index(afterScheme, "/"); i >= 0 {
+			template = afterScheme[i:]
+		} else {
+			template = "/"
+		}
+	}
+	template, _, _ = strings.Cut(template, "?")
+	return template
+}
@@ -0,0 +1,26 @@
+package tools
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandURLTemplate(t *testing.T) {
+	assert.Equal(t, "https://api/users/123", ExpandURLTemplate("https://api/users/{id}", "123"))
+	assert.Equal(t, "/users/a%2Fb/orders/{order}", ExpandURLTemplate("/users/{id}/orders/{order}", "a/b"))
+	assert.Equal(t, "/users", ExpandURLTemplate("/users", "ignored"))
+	assert.Equal(t, "/search/a&b?q=x%26admin%3Dtrue+1&page=2", ExpandURLTemplate("/search/{index}?q={query}&page={page}", "a&b", "x&admin=true 1", "2"))
+}
+
+func TestRouteOfTemplate(t *testing.T) {
+	assert.Equal(t, "/users/{id}", routeOfTemplate("https://api.example.com/users/{id}?expand=true"))
+	assert.Equal(t, "/", routeOfTemplate("https://api.example.com"))
+	assert.Equal(t, "/users/{id}", routeOfTemplate("/users/{id}"))
+}
+
+func TestRouteTemplateContext(t *testing.T) {
+	assert.Equal(t, "", RouteTemplateFromContext(context.Background()))
+	assert.Equal(t, "/users/{id}", RouteTemplateFromContext(ContextWithRouteTemplate(context.Background(), "/users/{id}")))
+}
@@ -1,10 +1,14 @@
 package tools
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Worker Manages a number of concurrent workers
 type Worker interface {
 	Acquire() (release func())
+	TryAcquire(timeout time.Duration) (release func(), ok bool)
 	size() int
 	available() int
 }
@@ -32,11 +36,32 @@ func NewWorker(numberOfConcurrentWorkers uint8) (Worker, error) {
 func (w *workerPool) Acquire() (release func()) {
 	w.throttle <- 1
 
-	release = func() {
-		<-w.throttle
+	return w.release
+}
+
+// TryAcquire Acquires a single worker, waiting at most timeout for one to become available
+func (w *workerPool) TryAcquire(timeout time.Duration) (release func(), ok bool) {
+	select {
+	case w.throttle <- 1:
+		return w.release, true
+	default:
+	}
+	if timeout <= 0 {
+		return nil, false
 	}
 
-	return
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case w.throttle <- 1:
+		return w.release, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+func (w *workerPool) release() {
+	<-w.throttle
 }
 
 // Size returns the number of workers
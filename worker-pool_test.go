@@ -1,6 +1,9 @@
 package tools
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestWorkerPool(t *testing.T) {
 
@@ -46,3 +49,45 @@ func TestWorkerPool(t *testing.T) {
 	})
 
 }
+
+func TestWorkerPool_TryAcquire(t *testing.T) {
+
+	t.Run("should not wait for a worker when the timeout is zero", func(t *testing.T) {
+		workerPool, _ := NewWorker(1)
+		release := workerPool.Acquire()
+		defer release()
+
+		if _, ok := workerPool.TryAcquire(0); ok {
+			t.Fatal("should not have acquired a worker")
+		}
+	})
+
+	t.Run("should acquire a worker released within the timeout", func(t *testing.T) {
+		workerPool, _ := NewWorker(1)
+		release := workerPool.Acquire()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			release()
+		}()
+
+		releaseSecond, ok := workerPool.TryAcquire(time.Second)
+		if !ok {
+			t.Fatal("should have acquired the released worker")
+		}
+		releaseSecond()
+
+		if workerPool.available() != 1 {
+			t.Fatalf("expected %d but got %d", 1, workerPool.available())
+		}
+	})
+
+	t.Run("should give up once the timeout passes", func(t *testing.T) {
+		workerPool, _ := NewWorker(1)
+		release := workerPool.Acquire()
+		defer release()
+
+		if _, ok := workerPool.TryAcquire(10 * time.Millisecond); ok {
+			t.Fatal("should not have acquired a worker")
+		}
+	})
+}